@@ -0,0 +1,33 @@
+package cjs
+
+import "encoding/json"
+
+// analysis is the JSON shape returned by AnalyzeJSON
+type analysis struct {
+	Exports    []string `json:"exports"`
+	Requires   []string `json:"requires"`
+	HasDefault bool     `json:"hasDefault"`
+}
+
+// AnalyzeJSON describes a CommonJS module as JSON for scripting, like:
+//
+//	{"exports":["a","default"],"requires":["/node_modules/react"],"hasDefault":true}
+//
+// exports are the names found by ParseExports, requires are the paths under
+// prefix found by ListRequires, and hasDefault reports whether module.exports
+// is assigned. The field names are stable.
+func AnalyzeJSON(path, prefix, source string) ([]byte, error) {
+	result, err := Parse(path, source, DefaultParseOptions())
+	if err != nil {
+		return nil, err
+	}
+	requires, err := ListRequires(path, prefix, source)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(analysis{
+		Exports:    result.Exports,
+		Requires:   requires,
+		HasDefault: result.HasDefault,
+	})
+}
@@ -0,0 +1,23 @@
+package cjs_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestAnalyzeJSON(t *testing.T) {
+	is := is.New(t)
+	out, err := cjs.AnalyzeJSON("test.js", "/node_modules/", `
+		var React = __require("/node_modules/react");
+		var local = require("./local");
+		exports.b = React.createElement;
+		exports.a = __require("/node_modules/react-dom");
+	`)
+	is.NoErr(err)
+	is.Equal(string(out), `{"exports":["a","b"],"requires":["/node_modules/react","/node_modules/react-dom"],"hasDefault":false}`)
+	out, err = cjs.AnalyzeJSON("test.js", "/node_modules/", `module.exports = 1;`)
+	is.NoErr(err)
+	is.Equal(string(out), `{"exports":["default"],"requires":[],"hasDefault":true}`)
+}
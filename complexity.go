@@ -0,0 +1,40 @@
+package cjs
+
+import (
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// Complexity parses code and returns the number of nodes in its syntax tree
+// and the tree's maximum depth. Servers can use it as a cheap gate to reject
+// pathological inputs before running ParseExports.
+func Complexity(path, code string) (nodes int, maxDepth int, err error) {
+	shebang, code := extractShebang(code)
+	ast, err := js.Parse(parse.NewInputString(code), js.Options{})
+	if err != nil {
+		return 0, 0, newParseError(path, shebang, code, err)
+	}
+	counter := &complexityCounter{}
+	js.Walk(counter, ast)
+	return counter.nodes, counter.maxDepth, nil
+}
+
+// complexityCounter counts the nodes it visits and tracks the deepest nesting
+type complexityCounter struct {
+	nodes    int
+	depth    int
+	maxDepth int
+}
+
+func (c *complexityCounter) Enter(n js.INode) js.IVisitor {
+	c.nodes++
+	c.depth++
+	if c.depth > c.maxDepth {
+		c.maxDepth = c.depth
+	}
+	return c
+}
+
+func (c *complexityCounter) Exit(n js.INode) {
+	c.depth--
+}
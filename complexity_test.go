@@ -0,0 +1,27 @@
+package cjs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestComplexity(t *testing.T) {
+	is := is.New(t)
+	// AST, block, expression statement, assignment, exports.a, exports, a, 1
+	nodes, depth, err := cjs.Complexity("test.js", "#!/usr/bin/env node\nexports.a = 1;")
+	is.NoErr(err)
+	is.Equal(nodes, 8)
+	is.Equal(depth, 6)
+	// Each nested array adds the array and its element to both
+	shallowNodes, shallowDepth, err := cjs.Complexity("test.js", "x = [1];")
+	is.NoErr(err)
+	nestedNodes, nestedDepth, err := cjs.Complexity("test.js", "x = "+strings.Repeat("[", 50)+"1"+strings.Repeat("]", 50)+";")
+	is.NoErr(err)
+	is.Equal(nestedNodes-shallowNodes, 98)
+	is.Equal(nestedDepth-shallowDepth, 98)
+	_, _, err = cjs.Complexity("test.js", "exports.a = ;")
+	is.True(err != nil)
+}
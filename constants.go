@@ -0,0 +1,100 @@
+package cjs
+
+import (
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// findConstants finds top-level bindings initialized to a string literal that
+// are never reassigned or redeclared, like `const KEY = "foo"`. It's a best
+// effort constant folding used to resolve export names like exports[KEY].
+func findConstants(ast *js.AST) map[*js.Var]string {
+	finder := &constantFinder{
+		values:  make(map[*js.Var]string),
+		dynamic: make(map[*js.Var]bool),
+		decls:   make(map[*js.Var]int),
+	}
+	for _, stmt := range ast.BlockStmt.List {
+		decl, ok := stmt.(*js.VarDecl)
+		if !ok {
+			continue
+		}
+		for _, item := range decl.List {
+			ident, ok := item.Binding.(*js.Var)
+			if !ok || item.Default == nil {
+				continue
+			}
+			if value, ok := stringLiteral(item.Default); ok {
+				finder.values[binding(ident)] = value
+			}
+		}
+	}
+	js.Walk(finder, ast)
+	constants := make(map[*js.Var]string, len(finder.values))
+	for ident, value := range finder.values {
+		if !finder.dynamic[ident] && finder.decls[ident] == 1 {
+			constants[ident] = value
+		}
+	}
+	return constants
+}
+
+// constantFinder tracks bindings by their *js.Var, so shadowing parameters
+// and declarations in nested scopes are separate bindings
+type constantFinder struct {
+	values  map[*js.Var]string
+	dynamic map[*js.Var]bool // Reassigned bindings
+	decls   map[*js.Var]int  // Number of declarations of each binding
+}
+
+func (f *constantFinder) Enter(n js.INode) js.IVisitor {
+	switch n := n.(type) {
+	case *js.VarDecl:
+		for _, item := range n.List {
+			if ident, ok := item.Binding.(*js.Var); ok {
+				f.decls[binding(ident)]++
+			}
+		}
+	case *js.FuncDecl:
+		if n.Name != nil {
+			f.decls[binding(n.Name)]++
+		}
+	case *js.BinaryExpr:
+		// KEY = ..., KEY += ...
+		if ident, ok := n.X.(*js.Var); ok && isAssignOp(n.Op) {
+			f.dynamic[binding(ident)] = true
+		}
+	case *js.UnaryExpr:
+		// KEY++, --KEY
+		if ident, ok := n.X.(*js.Var); ok {
+			switch n.Op {
+			case js.PreIncrToken, js.PreDecrToken, js.PostIncrToken, js.PostDecrToken:
+				f.dynamic[binding(ident)] = true
+			}
+		}
+	case *js.ForInStmt:
+		// for (KEY in obj)
+		if ident, ok := n.Init.(*js.Var); ok {
+			f.dynamic[binding(ident)] = true
+		}
+	case *js.ForOfStmt:
+		// for (KEY of list)
+		if ident, ok := n.Init.(*js.Var); ok {
+			f.dynamic[binding(ident)] = true
+		}
+	}
+	return f
+}
+
+func (f *constantFinder) Exit(n js.INode) {}
+
+// isAssignOp reports whether op assigns to its left operand
+func isAssignOp(op js.TokenType) bool {
+	switch op {
+	case js.EqToken, js.AddEqToken, js.SubEqToken, js.MulEqToken, js.DivEqToken,
+		js.ModEqToken, js.ExpEqToken, js.LtLtEqToken, js.GtGtEqToken, js.GtGtGtEqToken,
+		js.BitAndEqToken, js.BitOrEqToken, js.BitXorEqToken, js.AndEqToken, js.OrEqToken,
+		js.NullishEqToken:
+		return true
+	}
+	return false
+}
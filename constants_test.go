@@ -0,0 +1,48 @@
+package cjs_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestConstantKey(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		const KEY = "foo";
+		var OTHER = 'bar';
+		var CHANGED = "changed";
+		let COMPUTED = prefix + "computed";
+		var SHADOWED = "shadowed";
+		exports[KEY] = bar;
+		exports[OTHER] = baz;
+		exports[CHANGED] = 1;
+		exports[COMPUTED] = 2;
+		exports[UNKNOWN] = 4;
+		CHANGED = "other";
+		function f(SHADOWED) { exports[SHADOWED] = 3; }
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"bar",
+		"foo",
+	})
+}
+
+func TestConstantKeyShadowed(t *testing.T) {
+	is := is.New(t)
+	tests := []string{
+		`class A { m(KEY) { exports[KEY] = 1; } }`,
+		`try {} catch (KEY) { exports[KEY] = 1; }`,
+		`function f({ KEY }) { exports[KEY] = 1; }`,
+		`{ const [KEY] = list; exports[KEY] = 1; }`,
+		`function f() { class KEY {} exports[KEY] = 1; }`,
+		`var f = (KEY) => { exports[KEY] = 1; };`,
+	}
+	for _, test := range tests {
+		exports, err := cjs.ParseExports("test.js", `const KEY = "foo";`+test+`exports[KEY] = 2;`)
+		is.NoErr(err)
+		is.Equal(exports, []string{"foo"}) // only the top-level exports[KEY]
+	}
+}
@@ -0,0 +1,76 @@
+package cjs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// EmitDTS generates a TypeScript declaration skeleton for a module's exports.
+// Names that aren't valid identifiers are declared locally and re-exported
+// with an alias, which is only quoted when it isn't an IdentifierName, since
+// reserved words like class can be exported as is. The default export uses
+// `export =` when there are no named exports and `export default` otherwise.
+func EmitDTS(moduleName string, exports []string, hasDefault bool) (string, error) {
+	taken := make(map[string]bool, len(exports))
+	var named []string
+	for _, name := range exports {
+		if !utf8.ValidString(name) {
+			return "", fmt.Errorf("cjs: invalid export name %q in %s", name, moduleName)
+		}
+		if name == "default" {
+			hasDefault = true
+			continue
+		}
+		if taken[name] {
+			continue
+		}
+		taken[name] = true
+		named = append(named, name)
+	}
+
+	// Generate local names that don't collide with the exports
+	counter := 0
+	localName := func(base string) string {
+		for {
+			name := base
+			if counter > 0 {
+				name += strconv.Itoa(counter)
+			}
+			counter++
+			if !taken[name] {
+				taken[name] = true
+				return name
+			}
+		}
+	}
+
+	var sb strings.Builder
+	if moduleName != "" {
+		sb.WriteString(fmt.Sprintf("// Type definitions for %s\n", moduleName))
+	}
+	for _, name := range named {
+		if IsValidIdentifier(name) {
+			sb.WriteString(fmt.Sprintf("export declare const %s: any;\n", name))
+			continue
+		}
+		local := localName("_export")
+		sb.WriteString(fmt.Sprintf("declare const %s: any;\n", local))
+		alias := name
+		if !isIdentifierName(name) {
+			alias = quoteJS(name)
+		}
+		sb.WriteString(fmt.Sprintf("export { %s as %s };\n", local, alias))
+	}
+	if hasDefault {
+		local := localName("_default")
+		sb.WriteString(fmt.Sprintf("declare const %s: any;\n", local))
+		if len(named) == 0 {
+			sb.WriteString(fmt.Sprintf("export = %s;\n", local))
+		} else {
+			sb.WriteString(fmt.Sprintf("export default %s;\n", local))
+		}
+	}
+	return sb.String(), nil
+}
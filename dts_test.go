@@ -0,0 +1,92 @@
+package cjs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+func TestEmitDTSDefault(t *testing.T) {
+	is := is.New(t)
+	dts, err := cjs.EmitDTS("react", []string{"default"}, true)
+	is.NoErr(err)
+	is.Equal(dts, "// Type definitions for react\n"+
+		"declare const _default: any;\n"+
+		"export = _default;\n")
+}
+
+func TestEmitDTSNamed(t *testing.T) {
+	is := is.New(t)
+	dts, err := cjs.EmitDTS("react", []string{"Children", "default", "version"}, true)
+	is.NoErr(err)
+	is.Equal(dts, "// Type definitions for react\n"+
+		"export declare const Children: any;\n"+
+		"export declare const version: any;\n"+
+		"declare const _default: any;\n"+
+		"export default _default;\n")
+}
+
+func TestEmitDTSNonIdentifiers(t *testing.T) {
+	is := is.New(t)
+	dts, err := cjs.EmitDTS("", []string{"not identifier", "var", "_export", "ok"}, false)
+	is.NoErr(err)
+	is.Equal(dts, "declare const _export1: any;\n"+
+		"export { _export1 as \"not identifier\" };\n"+
+		"declare const _export2: any;\n"+
+		"export { _export2 as var };\n"+
+		"export declare const _export: any;\n"+
+		"export declare const ok: any;\n")
+}
+
+func TestIsValidIdentifier(t *testing.T) {
+	is := is.New(t)
+	is.True(cjs.IsValidIdentifier("foo"))
+	is.True(cjs.IsValidIdentifier("$foo_1"))
+	is.True(cjs.IsValidIdentifier("café"))
+	is.True(!cjs.IsValidIdentifier(""))
+	is.True(!cjs.IsValidIdentifier("1foo"))
+	is.True(!cjs.IsValidIdentifier("not identifier"))
+	is.True(!cjs.IsValidIdentifier("@foo"))
+	is.True(!cjs.IsValidIdentifier("var"))
+	is.True(!cjs.IsValidIdentifier("default"))
+}
+
+func TestEmitDTSAstralNames(t *testing.T) {
+	is := is.New(t)
+	dts, err := cjs.EmitDTS("", []string{"🌐", "a\x01b", "\U000E0001", "\u2028"}, false)
+	is.NoErr(err)
+	is.Equal(dts, "declare const _export: any;\n"+
+		"export { _export as \"🌐\" };\n"+
+		"declare const _export1: any;\n"+
+		"export { _export1 as \"a\\x01b\" };\n"+
+		"declare const _export2: any;\n"+
+		"export { _export2 as \"\\uDB40\\uDC01\" };\n"+
+		"declare const _export3: any;\n"+
+		"export { _export3 as \"\\u2028\" };\n")
+	// The output parses as JavaScript once the types are removed
+	code := strings.NewReplacer("declare const", "const", ": any;", " = 0;").Replace(dts)
+	_, err = js.Parse(parse.NewInputString(code), js.Options{})
+	is.NoErr(err)
+}
+
+func TestEmitDTSReservedWords(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `exports.class = 1; exports.import = 2; exports.ok = 3;`)
+	is.NoErr(err)
+	is.Equal(exports, []string{"class", "import", "ok"})
+	dts, err := cjs.EmitDTS("", exports, false)
+	is.NoErr(err)
+	is.Equal(dts, "declare const _export: any;\n"+
+		"export { _export as class };\n"+
+		"declare const _export1: any;\n"+
+		"export { _export1 as import };\n"+
+		"export declare const ok: any;\n")
+	// The output parses as JavaScript once the types are removed
+	code := strings.NewReplacer("declare const", "const", ": any;", " = 0;").Replace(dts)
+	_, err = js.Parse(parse.NewInputString(code), js.Options{})
+	is.NoErr(err)
+}
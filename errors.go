@@ -0,0 +1,79 @@
+package cjs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+)
+
+// ParseError is returned when the JavaScript source can't be parsed
+type ParseError struct {
+	// Path of the file that failed to parse
+	Path string
+	// Offset in the source where parsing failed, or -1 if unknown
+	Offset int
+	// Line and Column where parsing failed, starting at 1, or 0 if unknown
+	Line, Column int
+	// Err is the error from the parser
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cjs: failed to parse %s: %v", e.Path, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError wraps the parser error for code, which was parsed without the
+// shebang, with its position in the original source
+func newParseError(path, shebang, code string, err error) *ParseError {
+	perr := &ParseError{Path: path, Offset: -1, Err: err}
+	var lexErr *parse.Error
+	if !errors.As(err, &lexErr) {
+		return perr
+	}
+	perr.Line = lexErr.Line + strings.Count(shebang, "\n")
+	perr.Column = lexErr.Column
+	if offset := offsetAt(code, lexErr.Line, lexErr.Column); offset >= 0 {
+		perr.Offset = len(shebang) + offset
+	}
+	return perr
+}
+
+// offsetAt returns the byte offset of a line and column in the source, where
+// the column counts runes like the parser does, or -1 if it's out of range
+func offsetAt(source string, line, column int) int {
+	if line < 1 || column < 1 {
+		return -1
+	}
+	offset := 0
+	for current := 1; current < line; current++ {
+		end := strings.IndexAny(source[offset:], "\r\n\u2028\u2029")
+		if end < 0 {
+			return -1
+		}
+		offset += end
+		switch {
+		case strings.HasPrefix(source[offset:], "\r\n"):
+			offset += 2
+		case source[offset] == '\r' || source[offset] == '\n':
+			offset++
+		default:
+			offset += len("\u2028")
+		}
+	}
+	for i := range source[offset:] {
+		if column == 1 {
+			return offset + i
+		}
+		column--
+	}
+	if column == 1 {
+		return len(source)
+	}
+	return -1
+}
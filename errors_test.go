@@ -0,0 +1,29 @@
+package cjs_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestParseError(t *testing.T) {
+	is := is.New(t)
+	code := "#!/usr/bin/env node\nexports.a = 1;\nexports.b = );\n"
+	_, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.True(err != nil)
+	var perr *cjs.ParseError
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Path, "test.js")
+	is.Equal(perr.Line, 3)
+	is.Equal(perr.Column, 13)
+	is.Equal(perr.Offset, strings.Index(code, ");"))
+	is.True(strings.HasPrefix(err.Error(), "cjs: failed to parse test.js: unexpected )"))
+	_, err = cjs.RewriteRequires("test.js", "/node_modules/", "var a = __require('/node_modules/a');\nvar b = ;")
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Line, 2)
+	is.Equal(perr.Column, 9)
+	is.Equal(perr.Offset, 46)
+}
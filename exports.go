@@ -1,64 +1,124 @@
 package cjs
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/tdewolff/parse/v2"
 	"github.com/tdewolff/parse/v2/js"
 )
 
 func ParseExports(path, code string) ([]string, error) {
-	_, code = extractShebang(code)
-	ast, err := js.Parse(parse.NewInputString(string(code)), js.Options{})
+	result, err := Parse(path, code, DefaultParseOptions())
 	if err != nil {
-		return nil, fmt.Errorf("cjs: failed to parse %s: %w", path, err)
+		return nil, err
 	}
+	return result.Exports, nil
+}
 
-	visitor := &exportVisitor{
-		exports:          make(map[string]bool),
-		hasDefaultExport: false,
-		unsafeGetters:    make(map[string]bool),
+// ParseExportsWith is like ParseExports but accepts options. Start from
+// DefaultParseOptions to keep the behavior of ParseExports.
+func ParseExportsWith(path, code string, opts ParseOptions) ([]string, error) {
+	result, err := Parse(path, code, opts)
+	if err != nil {
+		return nil, err
 	}
+	return result.Exports, nil
+}
 
-	js.Walk(visitor, ast)
-
-	// Check for errors during traversal
-	if visitor.err != nil {
-		return nil, visitor.err
+// ParseExportsAST is like ParseExports but runs over an already parsed AST,
+// which avoids parsing twice in multi-pass pipelines. The parser doesn't
+// understand shebangs, so callers must strip them before parsing.
+func ParseExportsAST(ast *js.AST) ([]string, error) {
+	result, err := parseAST(ast, nil, 0, DefaultParseOptions())
+	if err != nil {
+		return nil, err
 	}
+	return result.Exports, nil
+}
 
-	// Remove any exports that were marked as unsafe getters
-	for name := range visitor.unsafeGetters {
-		delete(visitor.exports, name)
+// IsExported reports whether ParseExports would include name. "default" is
+// exported when module.exports is assigned or there's an explicit
+// exports.default. The whole file is still analyzed, since later code like an
+// unsafe getter can remove an export found earlier.
+func IsExported(path, code, name string) (bool, error) {
+	exports, err := ParseExports(path, code)
+	if err != nil {
+		return false, err
 	}
+	i := sort.SearchStrings(exports, name)
+	return i < len(exports) && exports[i] == name, nil
+}
 
-	// Convert map to slice
-	exports := make([]string, 0, len(visitor.exports))
-	for name := range visitor.exports {
-		exports = append(exports, name)
+// MergeExports unions the exports of an entry file with the exports of other
+// files it re-exports from, like from ParseExports. Only the entry file keeps
+// its "default" export. The result is sorted without duplicates.
+func MergeExports(entry []string, others ...[]string) []string {
+	seen := make(map[string]bool)
+	merged := []string{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
 	}
-
-	// Add default export if present
-	if visitor.hasDefaultExport {
-		exports = append(exports, "default")
+	for _, name := range entry {
+		add(name)
 	}
-
-	sort.Strings(exports)
-	return exports, nil
+	for _, exports := range others {
+		for _, name := range exports {
+			if name != "default" {
+				add(name)
+			}
+		}
+	}
+	sort.Strings(merged)
+	return merged
 }
 
 type exportVisitor struct {
+	opts             ParseOptions
 	err              error
 	exports          map[string]bool
+	order            []string // Exports in the order they were first found
 	unsafeGetters    map[string]bool
+	aliases          map[*js.Var]bool           // Variables aliasing exports, like `var e = exports`
+	moduleAliases    map[*js.Var]bool           // Parameters aliasing module, like `(function (m) {})(module)`
+	shadowed         map[*js.Var]bool           // Parameters named exports or module that aren't the real ones
+	objectVars       map[*js.Var]*js.ObjectExpr // Variables holding object literals, like shared descriptors
+	localProps       map[*js.Var][]string       // Static properties assigned to objectVars, like `out.a = 1`
+	dynamicLocals    map[*js.Var]bool           // objectVars that were reassigned or given dynamic properties
+	requireVars      map[string]string          // Variables holding a require, like `var m = require("x")`
+	copyHelpers      map[string]int             // Functions copying a param onto exports, like TypeScript's __export
+	copyKeys         map[*js.Var]bool           // Keys of loops copying a re-export onto exports, like p in `exports[p] = m[p]`
+	reexports        []Reexport
+	requires         []string           // Specifiers of static requires, like `require("x")`
+	constants        map[*js.Var]string // String constants, like `const KEY = "foo"`
+	details          map[string]Export  // Details of exports, keyed by name
+	src              []byte             // Source of the AST, if known
+	base             int                // Offset of src in the original code
+	diagnostics      []Diagnostic
 	hasDefaultExport bool
+	wrappers         map[*js.FuncDecl]bool // Functions called with the module's `this`, like `(function () {}).call(this)`
+	assignSites      map[string][]int      // Offsets of the assignments to each export, like `exports.x = 1`
+	forEachKeys      map[*js.Var]bool      // Parameters of forEach callbacks over known export names
+	thisDepth        int                   // Number of enclosing functions and classes that bind their own `this`
 }
 
-func (r *exportVisitor) Exit(n js.INode) {}
+func (r *exportVisitor) Exit(n js.INode) {
+	if r.bindsThis(n) {
+		r.thisDepth--
+	}
+}
 
 func (v *exportVisitor) Enter(n js.INode) js.IVisitor {
+	if v.bindsThis(n) {
+		v.thisDepth++
+	}
+
 	// Handle BinaryExpr (assignments)
 	if bin, ok := n.(*js.BinaryExpr); ok {
 		if bin.Op == js.EqToken {
@@ -68,70 +128,174 @@ func (v *exportVisitor) Enter(n js.INode) js.IVisitor {
 
 	// Handle CallExpr (Object.defineProperty, etc.)
 	if call, ok := n.(*js.CallExpr); ok {
+		if specifier := v.requireSpecifier(call); specifier != "" {
+			v.addRequire(specifier)
+		}
+		v.trackWrapper(call)
 		v.handleCallExpr(call)
+		v.handleFactoryCall(call)
+		if v.opts.DetectUMD {
+			v.handleUMDWrapper(call)
+		}
+		if v.opts.InspectForEach {
+			v.handleForEach(call)
+		}
 	}
 
+	// Handle VarDecl (aliases of exports)
+	if decl, ok := n.(*js.VarDecl); ok {
+		v.handleVarDecl(decl)
+	}
+
+	// Handle star re-exports
+	v.handleStarReexport(n)
+
 	return v
 }
 
 func (v *exportVisitor) handleAssignment(left, right js.IExpr) {
 	// Check for exports.foo = ... or module.exports.foo = ...
 	if dot, ok := left.(*js.DotExpr); ok {
-		if v.isExportsIdent(dot.X) {
-			// exports.foo = ...
-			// Property name can be either *js.Var or js.LiteralExpr (no pointer)
-			if ident, ok := dot.Y.(*js.Var); ok {
-				v.exports[string(ident.Data)] = true
-			} else if lit, ok := dot.Y.(js.LiteralExpr); ok {
-				v.exports[string(lit.Data)] = true
-			}
-		} else if v.isModuleExports(dot.X) {
-			// module.exports.foo = ...
-			if ident, ok := dot.Y.(*js.Var); ok {
-				v.exports[string(ident.Data)] = true
-			} else if lit, ok := dot.Y.(js.LiteralExpr); ok {
-				v.exports[string(lit.Data)] = true
+		if v.isExportsObject(dot.X) {
+			// exports.foo = ... or module.exports.foo = ...
+			if name := v.extractDotName(dot.Y); name != "" {
+				v.addExport(name, "exports-assign")
+				v.assignSites[name] = append(v.assignSites[name], v.offsetOf(dot.Y))
 			}
 		} else if v.isModuleIdent(dot.X) && v.isExportsField(dot.Y) {
 			// module.exports = ...
-			v.hasDefaultExport = true
-			// Check if it's an object literal
-			if obj, ok := right.(*js.ObjectExpr); ok {
-				v.extractObjectKeys(obj)
-			}
+			v.handleModuleExportsValue(right)
+		} else if v.isGlobalExports(dot) {
+			// globalThis.MyLib = ...
+			v.handleModuleExportsValue(right)
+		} else if ident, ok := dot.X.(*js.Var); ok {
+			// out.foo = ... on a local object
+			v.trackLocalProp(ident, v.extractDotName(dot.Y))
 		}
 	} else if index, ok := left.(*js.IndexExpr); ok {
-		// exports['foo'] = ... or module.exports['foo'] = ...
-		if v.isExportsIdent(index.X) || v.isModuleExports(index.X) {
-			if name := v.extractStringLiteral(index.Y); name != "" {
-				v.exports[name] = true
+		// exports['foo'] = ... or module.exports['foo'] = ... or exports[KEY] = ...
+		// Dynamic keys like exports[p] resolve to "" and are skipped
+		if v.isExportsObject(index.X) {
+			if name := v.extractStaticString(index.Y); name != "" {
+				v.addExport(name, "exports-assign")
+				v.assignSites[name] = append(v.assignSites[name], v.offsetOf(index.Y))
+			} else if !v.isReexportCopy(index, right) && !v.isForEachKey(index.Y) {
+				v.strictError(fmt.Errorf("cjs: dynamic export key in %s", jsString(index)))
 			}
+		} else if ident, ok := index.X.(*js.Var); ok {
+			// out['foo'] = ... on a local object
+			v.trackLocalProp(ident, v.extractStaticString(index.Y))
+		}
+	} else if ident, ok := left.(*js.Var); ok {
+		// Reassigned aliases and local objects are no longer known
+		delete(v.aliases, binding(ident))
+		if right != nil && v.isExportsObject(right) {
+			v.aliases[binding(ident)] = true
 		}
+		v.dynamicLocals[binding(ident)] = true
 	} else if v.isModuleExports(left) {
 		// module.exports = ...
-		v.hasDefaultExport = true
-		// Check if it's an object literal
-		if obj, ok := right.(*js.ObjectExpr); ok {
-			v.extractObjectKeys(obj)
+		v.handleModuleExportsValue(right)
+	} else if obj, ok := left.(*js.ObjectExpr); ok {
+		// ({ a: exports.a, b: module.exports.b } = source)
+		for _, prop := range obj.List {
+			v.handleAssignment(prop.Value, nil)
+		}
+	} else if arr, ok := left.(*js.ArrayExpr); ok {
+		// [exports.a, exports.b] = source
+		for _, elem := range arr.List {
+			if elem.Value != nil {
+				v.handleAssignment(elem.Value, nil)
+			}
 		}
 	}
 }
 
+// handleModuleExportsValue handles the right-hand side of module.exports = ...
+func (v *exportVisitor) handleModuleExportsValue(right js.IExpr) {
+	v.hasDefaultExport = true
+	v.extractModuleExportsKeys(right)
+}
+
+// extractModuleExportsKeys extracts the statically known keys of a value
+// assigned to module.exports
+func (v *exportVisitor) extractModuleExportsKeys(right js.IExpr) {
+	switch right := right.(type) {
+	case *js.GroupExpr:
+		v.extractModuleExportsKeys(right.X)
+	case *js.CondExpr:
+		// module.exports = cond ? { ... } : { ... } could be either shape
+		v.extractModuleExportsKeys(right.X)
+		v.extractModuleExportsKeys(right.Y)
+	case *js.ObjectExpr:
+		// module.exports = { ... }
+		v.extractObjectKeys(right, "module-exports-object")
+	case *js.CallExpr:
+		// module.exports = require("dep")
+		if specifier := v.requireSpecifier(right); specifier != "" {
+			v.addReexport(specifier)
+		}
+		// module.exports = Object.assign(module.exports, { ... })
+		if v.isObjectAssign(right.X) {
+			for _, arg := range right.Args.List {
+				if obj, ok := arg.Value.(*js.ObjectExpr); ok && !arg.Rest {
+					v.extractObjectKeys(obj, "object-assign")
+				}
+			}
+		}
+		// module.exports = (() => ({ ... }))()
+		if value := conciseArrowValue(right.X); value != nil {
+			v.extractModuleExportsKeys(value)
+		}
+	}
+}
+
+// conciseArrowValue returns the value of an arrow function with a concise
+// body like `() => ({ ... })`, or nil
+func conciseArrowValue(expr js.IExpr) js.IExpr {
+	arrow, ok := unwrapGroup(expr).(*js.ArrowFunc)
+	if !ok || len(arrow.Body.List) != 1 {
+		return nil
+	}
+	ret, ok := arrow.Body.List[0].(*js.ReturnStmt)
+	if !ok {
+		return nil
+	}
+	return ret.Value
+}
+
 func (v *exportVisitor) handleCallExpr(call *js.CallExpr) {
-	// Check for Object.defineProperty(exports, 'name', { ... })
+	// Check for Object.assign(module.exports, { ... }, require("dep"))
+	if v.extendsExports(call) {
+		v.handleObjectAssign(call.Args.List[1:])
+		return
+	}
+
+	// Check for Object.defineProperty(exports, 'name', { ... }) or
+	// Reflect.defineProperty(exports, 'name', { ... })
 	if dot, ok := call.X.(*js.DotExpr); ok {
-		if v.isObjectIdent(dot.X) && v.isDefinePropertyField(dot.Y) {
+		if (v.isObjectIdent(dot.X) || v.isReflectIdent(dot.X)) && v.isDefinePropertyField(dot.Y) {
 			if len(call.Args.List) >= 3 {
-				// First arg should be exports or module.exports
-				if v.isExportsIdent(call.Args.List[0].Value) || v.isModuleExports(call.Args.List[0].Value) {
-					// Second arg is the property name
-					if name := v.extractStringLiteral(call.Args.List[1].Value); name != "" {
-						// Third arg is the descriptor
-						if obj, ok := call.Args.List[2].Value.(*js.ObjectExpr); ok {
-							if v.shouldExportDefineProperty(obj, name) {
-								v.exports[name] = true
-							}
+				// First arg should be exports, module.exports or an alias of them
+				if v.isExportsObject(call.Args.List[0].Value) {
+					// Second arg is the property name, third is the descriptor
+					name := v.extractPropertyKey(call.Args.List[1].Value)
+					v.defineExport(name, call.Args.List[1].Value, call.Args.List[2].Value)
+				}
+			}
+		} else if v.isObjectIdent(dot.X) && v.extractDotName(dot.Y) == "defineProperties" {
+			// Object.defineProperties(exports, { name: { ... } })
+			if len(call.Args.List) >= 2 && v.isExportsObject(call.Args.List[0].Value) {
+				if props, ok := call.Args.List[1].Value.(*js.ObjectExpr); ok {
+					for _, prop := range props.List {
+						if prop.Spread || prop.Name == nil || !prop.Name.IsSet() {
+							continue
 						}
+						key := js.IExpr(prop.Name.Literal)
+						if prop.Name.Computed != nil {
+							key = prop.Name.Computed
+						}
+						v.defineExport(v.extractPropertyName(prop.Name), key, prop.Value)
 					}
 				}
 			}
@@ -139,8 +303,383 @@ func (v *exportVisitor) handleCallExpr(call *js.CallExpr) {
 	}
 }
 
-func (v *exportVisitor) shouldExportDefineProperty(obj *js.ObjectExpr, name string) bool {
+// defineExport exports a property defined on exports with a descriptor, like
+// Object.defineProperty(exports, key, descriptor), where key is the
+// expression of the name
+func (v *exportVisitor) defineExport(name string, key, descriptor js.IExpr) {
+	if name == "" {
+		return
+	}
+	obj := v.descriptorObject(descriptor)
+	if obj == nil {
+		return
+	}
+	defined := v.exports[name]
+	if via, ok := v.shouldExportDefineProperty(obj, name); ok {
+		v.addExport(name, via)
+	} else if v.unsafeGetters[name] {
+		offset := v.offsetOf(key)
+		if defined {
+			v.conflictingGetter(name, offset)
+		}
+		v.strictError(fmt.Errorf("cjs: unsafe getter for export %q at offset %d", name, offset))
+	}
+}
+
+// conflictingGetter handles an unsafe getter for an export that was already
+// defined safely, which either drops the export or keeps the earlier definition
+func (v *exportVisitor) conflictingGetter(name string, offset int) {
+	message := "export %q is dropped because it's redefined with an unsafe getter"
+	if v.opts.SafeDefinitionWins {
+		delete(v.unsafeGetters, name)
+		message = "export %q is kept even though it's redefined with an unsafe getter"
+	}
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Offset:  offset,
+		Message: fmt.Sprintf(message, name),
+	})
+}
+
+// addExport adds a named export, recording how it was first declared
+func (v *exportVisitor) addExport(name, via string) {
+	v.exports[name] = true
+	detail := v.details[name]
+	if detail.Via == "" {
+		detail.Name = name
+		detail.Via = via
+		v.details[name] = detail
+		v.order = append(v.order, name)
+	}
+}
+
+// handleObjectAssign exports the sources of Object.assign(exports, ...).
+// Required modules are re-exported, but their keys are dynamic, so without a
+// resolver only the default export is known.
+func (v *exportVisitor) handleObjectAssign(sources []js.Arg) {
+	for _, arg := range sources {
+		if arg.Rest {
+			continue
+		}
+		switch value := unwrapGroup(arg.Value).(type) {
+		case *js.ObjectExpr:
+			v.extractObjectKeys(value, "object-assign")
+		case *js.CallExpr:
+			if specifier := v.requireSpecifier(value); specifier != "" {
+				v.hasDefaultExport = true
+				v.reexport(specifier)
+			}
+		}
+	}
+}
+
+// strictError fails the parse in strict mode
+func (v *exportVisitor) strictError(err error) {
+	if v.opts.Strict && v.err == nil {
+		v.err = err
+	}
+}
+
+// isForEachKey reports whether expr is the key of a forEach over known names
+func (v *exportVisitor) isForEachKey(expr js.IExpr) bool {
+	key, ok := expr.(*js.Var)
+	return ok && v.forEachKeys[key]
+}
+
+// isReexportCopy reports whether `exports[key] = right` copies the same key
+// from another object in a loop recorded as a re-export, like
+// `for (var p in m) exports[p] = m[p]` where m is a require result, or in
+// the loop of a copy helper like TypeScript's __export
+func (v *exportVisitor) isReexportCopy(left *js.IndexExpr, right js.IExpr) bool {
+	key, ok := left.Y.(*js.Var)
+	if !ok || !v.copyKeys[binding(key)] {
+		return false
+	}
+	index, ok := right.(*js.IndexExpr)
+	return ok && isIdentNamed(index.Y, string(key.Data))
+}
+
+// unwrapGroup removes any parentheses around expr
+func unwrapGroup(expr js.IExpr) js.IExpr {
+	for {
+		group, ok := expr.(*js.GroupExpr)
+		if !ok {
+			return expr
+		}
+		expr = group.X
+	}
+}
+
+// jsString returns the JavaScript source of a node
+func jsString(node js.INode) string {
+	var sb strings.Builder
+	node.JS(&sb)
+	return sb.String()
+}
+
+// trackLocalProp records a property assigned to a local object like
+// `var out = {}; out.foo = 1`, or marks the object as unknown if the name
+// isn't static
+func (v *exportVisitor) trackLocalProp(ident *js.Var, name string) {
+	ident = binding(ident)
+	if _, ok := v.objectVars[ident]; !ok {
+		return
+	}
+	if name == "" {
+		v.dynamicLocals[ident] = true
+		return
+	}
+	v.localProps[ident] = append(v.localProps[ident], name)
+}
+
+// descriptorObject returns the properties of a descriptor, which is either an
+// object literal, a variable holding one, or a single-level
+// Object.assign({ ... }, D) of them
+func (v *exportVisitor) descriptorObject(expr js.IExpr) *js.ObjectExpr {
+	switch expr := expr.(type) {
+	case *js.ObjectExpr:
+		return expr
+	case *js.Var:
+		return v.objectVars[binding(expr)]
+	case *js.CallExpr:
+		if !v.isObjectAssign(expr.X) {
+			return nil
+		}
+		merged := &js.ObjectExpr{}
+		for _, arg := range expr.Args.List {
+			var obj *js.ObjectExpr
+			switch value := arg.Value.(type) {
+			case *js.ObjectExpr:
+				obj = value
+			case *js.Var:
+				obj = v.objectVars[binding(value)]
+			}
+			if obj == nil || arg.Rest {
+				return nil
+			}
+			merged.List = append(merged.List, obj.List...)
+		}
+		return merged
+	}
+	return nil
+}
+
+// handleFactoryCall binds the parameters of an IIFE like
+// `(function (exports, module) { ... })(exports, module)` to its arguments.
+// Parameters passed the real exports or module are treated as exports or
+// module, while parameters named exports or module that are passed anything
+// else shadow them.
+func (v *exportVisitor) handleFactoryCall(call *js.CallExpr) {
+	callee, args := unwrapGroup(call.X), call.Args.List
+	// (function (exports) { ... }).call(this, exports)
+	if dot, ok := callee.(*js.DotExpr); ok && v.extractDotName(dot.Y) == "call" && len(args) > 0 {
+		callee, args = unwrapGroup(dot.X), args[1:]
+	}
+	var params js.Params
+	switch fn := callee.(type) {
+	case *js.FuncDecl:
+		params = fn.Params
+	case *js.ArrowFunc:
+		params = fn.Params
+	default:
+		return
+	}
+	for i, param := range params.List {
+		ident, ok := param.Binding.(*js.Var)
+		if !ok {
+			continue
+		}
+		var arg js.IExpr
+		if i < len(args) && !args[i].Rest {
+			arg = args[i].Value
+		}
+		isExports := arg != nil && v.isExportsObject(arg)
+		isModule := arg != nil && v.isModuleIdent(arg)
+		switch string(ident.Data) {
+		case "exports":
+			if !isExports {
+				v.shadowed[ident] = true
+			}
+		case "module":
+			if !isModule {
+				v.shadowed[ident] = true
+			}
+		default:
+			if isExports {
+				v.aliases[ident] = true
+			} else if isModule {
+				v.moduleAliases[ident] = true
+			}
+		}
+	}
+}
+
+// handleUMDWrapper detects the UMD wrapper
+//
+//	(function (global, factory) {
+//		typeof exports === 'object' && typeof module !== 'undefined' ? factory(exports) : ...
+//	})(this, function (e) { e.foo = 1; });
+//
+// and treats the first parameter of the factory as exports
+func (v *exportVisitor) handleUMDWrapper(call *js.CallExpr) {
+	wrapper, ok := unwrapGroup(call.X).(*js.FuncDecl)
+	if !ok || !hasTypeofExportsCheck(wrapper) {
+		return
+	}
+	for _, arg := range call.Args.List {
+		var params js.Params
+		switch fn := arg.Value.(type) {
+		case *js.FuncDecl:
+			params = fn.Params
+		case *js.ArrowFunc:
+			params = fn.Params
+		default:
+			continue
+		}
+		if len(params.List) == 0 {
+			continue
+		}
+		if ident, ok := params.List[0].Binding.(*js.Var); ok {
+			v.aliases[ident] = true
+		}
+	}
+}
+
+// hasTypeofExportsCheck reports whether the function checks
+// `typeof exports === 'object'`, which is characteristic of UMD wrappers
+func hasTypeofExportsCheck(fn *js.FuncDecl) bool {
+	finder := &typeofExportsFinder{}
+	js.Walk(finder, &fn.Body)
+	return finder.found
+}
+
+type typeofExportsFinder struct {
+	found bool
+}
+
+func (f *typeofExportsFinder) Enter(n js.INode) js.IVisitor {
+	if f.found {
+		return nil
+	}
+	bin, ok := n.(*js.BinaryExpr)
+	if !ok || (bin.Op != js.EqEqEqToken && bin.Op != js.EqEqToken) {
+		return f
+	}
+	if isTypeofExports(bin.X) && isStringLiteral(bin.Y, "object") ||
+		isTypeofExports(bin.Y) && isStringLiteral(bin.X, "object") {
+		f.found = true
+		return nil
+	}
+	return f
+}
+
+func (f *typeofExportsFinder) Exit(n js.INode) {}
+
+// handleForEach exports the names of a forEach over an array of strings that
+// assigns each one to exports, like
+// `["a", "b"].forEach(function (k) { exports[k] = impl[k]; })`
+func (v *exportVisitor) handleForEach(call *js.CallExpr) {
+	dot, ok := call.X.(*js.DotExpr)
+	if !ok || v.extractDotName(dot.Y) != "forEach" || len(call.Args.List) == 0 {
+		return
+	}
+	arr, ok := unwrapGroup(dot.X).(*js.ArrayExpr)
+	if !ok {
+		return
+	}
+	var names []string
+	for _, elem := range arr.List {
+		name, ok := stringLiteral(elem.Value)
+		if !ok || elem.Spread {
+			return
+		}
+		names = append(names, name)
+	}
+	var params js.Params
+	var body js.BlockStmt
+	switch fn := unwrapGroup(call.Args.List[0].Value).(type) {
+	case *js.FuncDecl:
+		params, body = fn.Params, fn.Body
+	case *js.ArrowFunc:
+		params, body = fn.Params, fn.Body
+	default:
+		return
+	}
+	if len(params.List) == 0 {
+		return
+	}
+	key, ok := params.List[0].Binding.(*js.Var)
+	if !ok {
+		return
+	}
+	finder := &exportsKeyFinder{v: v, key: key}
+	js.Walk(finder, &body)
+	if !finder.found {
+		return
+	}
+	v.forEachKeys[key] = true
+	for _, name := range names {
+		if name != "" {
+			v.addExport(name, "exports-assign")
+		}
+	}
+}
+
+// exportsKeyFinder looks for an assignment like `exports[key] = ...`
+type exportsKeyFinder struct {
+	v     *exportVisitor
+	key   *js.Var
+	found bool
+}
+
+func (f *exportsKeyFinder) Enter(n js.INode) js.IVisitor {
+	if f.found {
+		return nil
+	}
+	bin, ok := n.(*js.BinaryExpr)
+	if !ok || bin.Op != js.EqToken {
+		return f
+	}
+	if index, ok := bin.X.(*js.IndexExpr); ok && index.Y == f.key && f.v.isExportsObject(index.X) {
+		f.found = true
+		return nil
+	}
+	return f
+}
+
+func (f *exportsKeyFinder) Exit(n js.INode) {}
+
+// isTypeofExports reports whether expr is `typeof exports`
+func isTypeofExports(expr js.IExpr) bool {
+	unary, ok := expr.(*js.UnaryExpr)
+	return ok && unary.Op == js.TypeofToken && isIdentNamed(unary.X, "exports")
+}
+
+// isStringLiteral reports whether expr is a string literal with the value
+func isStringLiteral(expr js.IExpr, value string) bool {
+	s, ok := stringLiteral(expr)
+	return ok && s == value
+}
+
+// handleVarDecl tracks aliases like `var e = exports` or `const m = module.exports`
+func (v *exportVisitor) handleVarDecl(decl *js.VarDecl) {
+	for _, item := range decl.List {
+		ident, ok := item.Binding.(*js.Var)
+		if !ok || item.Default == nil {
+			continue
+		}
+		if v.isExportsObject(item.Default) {
+			v.aliases[binding(ident)] = true
+		} else if obj, ok := item.Default.(*js.ObjectExpr); ok {
+			v.objectVars[binding(ident)] = obj
+		}
+	}
+}
+
+// shouldExportDefineProperty reports whether a defineProperty descriptor
+// defines an export, and whether it's a "getter" or a "define-property" value
+func (v *exportVisitor) shouldExportDefineProperty(obj *js.ObjectExpr, name string) (string, bool) {
 	hasGetter := false
+	hasSetter := false
 	hasValue := false
 	enumerableFalse := false
 
@@ -154,8 +693,11 @@ func (v *exportVisitor) shouldExportDefineProperty(obj *js.ObjectExpr, name stri
 				// Check if it's a safe getter
 				if !v.isSafeGetterMethod(method) {
 					v.unsafeGetters[name] = true
-					return false
+					return "", false
 				}
+				v.trackGetterReexport(name, method.Body)
+			} else if methodName == "set" || method.Set {
+				hasSetter = true
 			}
 			continue
 		}
@@ -172,15 +714,18 @@ func (v *exportVisitor) shouldExportDefineProperty(obj *js.ObjectExpr, name stri
 			// Check if it's a safe getter (returns a static member access)
 			if !v.isSafeGetter(prop.Value) {
 				v.unsafeGetters[name] = true
-				return false
+				return "", false
 			}
+			body, _ := getterBody(prop.Value)
+			v.trackGetterReexport(name, body)
+		case "set":
+			hasSetter = true
 		case "value":
 			hasValue = true
 		case "enumerable":
+			// Later properties override earlier ones in merged descriptors
 			if lit, ok := prop.Value.(*js.LiteralExpr); ok {
-				if string(lit.Data) == "false" {
-					enumerableFalse = true
-				}
+				enumerableFalse = string(lit.Data) == "false"
 			}
 		}
 	}
@@ -188,72 +733,146 @@ func (v *exportVisitor) shouldExportDefineProperty(obj *js.ObjectExpr, name stri
 	// Check if this property was previously marked as unsafe
 	if v.unsafeGetters[name] {
 		delete(v.exports, name)
-		return false
+		return "", false
 	}
 
 	// If it has a getter and enumerable is false, don't export
 	if hasGetter && enumerableFalse {
-		return false
+		return "", false
+	}
+
+	// Getters with setters are live bindings that can change
+	if hasGetter && hasSetter {
+		detail := v.details[name]
+		detail.Name = name
+		detail.Kind = "live"
+		v.details[name] = detail
 	}
 
 	// If it has either a value or a getter, export it
-	return hasValue || hasGetter
+	if hasGetter {
+		return "getter", true
+	}
+	return "define-property", hasValue
 }
 
 func (v *exportVisitor) isSafeGetter(expr js.IExpr) bool {
 	// A safe getter is a function that returns a static member access
-	// like: function() { return obj.prop; }
-	fn, ok := expr.(*js.FuncDecl)
+	// like: function() { return obj.prop; } or () => obj.prop
+	body, ok := getterBody(expr)
 	if !ok {
 		return false
 	}
+	return v.isSafeGetterBody(body)
+}
 
-	if len(fn.Body.List) == 0 {
-		return false
+// getterBody returns the body of a getter function. The parser gives concise
+// arrow functions like `() => obj.prop` a body with a single return.
+func getterBody(expr js.IExpr) (js.BlockStmt, bool) {
+	switch fn := expr.(type) {
+	case *js.FuncDecl:
+		return fn.Body, true
+	case *js.ArrowFunc:
+		return fn.Body, true
 	}
+	return js.BlockStmt{}, false
+}
+
+func (v *exportVisitor) isSafeGetterMethod(method *js.MethodDecl) bool {
+	// A safe getter is a method that returns a static member access
+	return v.isSafeGetterBody(method.Body)
+}
 
-	// Look for a return statement
-	for _, stmt := range fn.Body.List {
-		if ret, ok := stmt.(*js.ReturnStmt); ok {
-			if ret.Value != nil {
-				// Check if it's a dot or index expression (static member access)
-				switch ret.Value.(type) {
-				case *js.DotExpr, *js.IndexExpr, *js.Var:
-					return true
+// isSafeGetterBody looks for a return statement with a static member access,
+// resolving simple const aliases like: const v = ns.val; return v;
+func (v *exportVisitor) isSafeGetterBody(body js.BlockStmt) bool {
+	consts := make(map[string]js.IExpr)
+	for _, stmt := range body.List {
+		switch stmt := stmt.(type) {
+		case *js.VarDecl:
+			if stmt.TokenType != js.ConstToken {
+				continue
+			}
+			for _, item := range stmt.List {
+				if ident, ok := item.Binding.(*js.Var); ok && item.Default != nil {
+					consts[string(ident.Data)] = item.Default
 				}
 			}
+		case *js.ReturnStmt:
+			if stmt.Value != nil && v.isStaticAccess(stmt.Value, consts) {
+				return true
+			}
 		}
 	}
-
 	return false
 }
 
-func (v *exportVisitor) isSafeGetterMethod(method *js.MethodDecl) bool {
-	// A safe getter is a method that returns a static member access
-	if len(method.Body.List) == 0 {
-		return false
+// trackGetterReexport records where a live binding getter like
+// `get: function () { return require("./y").x; }` re-exports from
+func (v *exportVisitor) trackGetterReexport(name string, body js.BlockStmt) {
+	for _, stmt := range body.List {
+		ret, ok := stmt.(*js.ReturnStmt)
+		if !ok || ret.Value == nil {
+			continue
+		}
+		dot, ok := ret.Value.(*js.DotExpr)
+		if !ok {
+			return
+		}
+		specifier := v.requireSpecifier(dot.X)
+		if ident, ok := dot.X.(*js.Var); ok {
+			specifier = v.requireVars[string(ident.Data)]
+		}
+		if member := v.extractDotName(dot.Y); specifier != "" && member != "" {
+			detail := v.details[name]
+			detail.Name = name
+			detail.ReexportFrom = specifier
+			detail.ReexportName = member
+			v.details[name] = detail
+		}
+		return
 	}
+}
 
-	// Look for a return statement
-	for _, stmt := range method.Body.List {
-		if ret, ok := stmt.(*js.ReturnStmt); ok {
-			if ret.Value != nil {
-				// Check if it's a dot or index expression (static member access)
-				switch ret.Value.(type) {
-				case *js.DotExpr, *js.IndexExpr, *js.Var:
-					return true
-				}
-			}
+// isStaticAccess reports whether expr is a dot or index expression (static
+// member access) or an identifier, following the getter's local consts
+func (v *exportVisitor) isStaticAccess(expr js.IExpr, consts map[string]js.IExpr) bool {
+	switch expr := expr.(type) {
+	case *js.DotExpr, *js.IndexExpr:
+		return true
+	case *js.CommaExpr:
+		// return a.b, a.c evaluates to the last operand
+		if len(expr.List) == 0 {
+			return false
+		}
+		return v.isStaticAccess(expr.List[len(expr.List)-1], consts)
+	case *js.Var:
+		init, ok := consts[string(expr.Data)]
+		if !ok {
+			return true
 		}
+		// Remove the binding while resolving to avoid cycles
+		delete(consts, string(expr.Data))
+		return v.isStaticAccess(init, consts)
 	}
-
 	return false
 }
 
-func (v *exportVisitor) extractObjectKeys(obj *js.ObjectExpr) {
+// extractObjectKeys exports the keys of an object, recording via as how they
+// were declared
+func (v *exportVisitor) extractObjectKeys(obj *js.ObjectExpr, via string) {
 	for _, prop := range obj.List {
-		// Skip spread properties
+		// Skip spread properties, but keep track of ...require("dep") and
+		// merge the keys of local objects like ...out. Spreading ...exports
+		// keeps the exports found so far.
 		if prop.Spread {
+			if v.isExportsObject(prop.Value) {
+				continue
+			} else if specifier := v.requireSpecifier(prop.Value); specifier != "" {
+				v.addReexport(specifier)
+			} else if ident, ok := prop.Value.(*js.Var); ok {
+				v.extractLocalKeys(ident, via)
+			}
 			continue
 		}
 
@@ -263,21 +882,202 @@ func (v *exportVisitor) extractObjectKeys(obj *js.ObjectExpr) {
 
 		// Extract the key name
 		if keyName := v.extractPropertyName(prop.Name); keyName != "" {
-			v.exports[keyName] = true
+			v.addExport(keyName, via)
 		}
 	}
 }
 
+// checkShadowedExports warns about named exports assigned at the top level
+// before a `module.exports = ...` reassignment, which discards them at runtime
+func (v *exportVisitor) checkShadowedExports(stmts []js.IStmt) {
+	var names []string
+	for _, stmt := range stmts {
+		expr, ok := stmt.(*js.ExprStmt)
+		if !ok {
+			continue
+		}
+		bin, ok := expr.Value.(*js.BinaryExpr)
+		if !ok || bin.Op != js.EqToken {
+			continue
+		}
+		switch left := bin.X.(type) {
+		case *js.DotExpr:
+			if v.isExportsObject(left.X) {
+				if name := v.extractDotName(left.Y); name != "" {
+					names = append(names, name)
+				}
+				continue
+			}
+			if !v.isModuleIdent(left.X) || !v.isExportsField(left.Y) || len(names) == 0 {
+				continue
+			}
+			// module.exports = exports, module.exports = Object.assign(exports, ...)
+			// and module.exports = { ...exports } keep the named exports
+			if v.isExportsObject(bin.Y) || v.extendsExports(bin.Y) || v.spreadsExports(bin.Y) {
+				continue
+			}
+			for _, name := range names {
+				v.diagnostics = append(v.diagnostics, Diagnostic{
+					Offset:  v.offsetOf(left.Y),
+					Message: fmt.Sprintf("export %q is shadowed by the module.exports reassignment", name),
+				})
+			}
+			names = nil
+		case *js.IndexExpr:
+			if v.isExportsObject(left.X) {
+				if name := v.extractStaticString(left.Y); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+}
+
+// spreadsExports reports whether expr is an object that spreads the current
+// exports, like { ...exports, extra: 1 }
+func (v *exportVisitor) spreadsExports(expr js.IExpr) bool {
+	obj, ok := expr.(*js.ObjectExpr)
+	if !ok {
+		return false
+	}
+	for _, prop := range obj.List {
+		if prop.Spread && v.isExportsObject(prop.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReassignedExports warns about exports assigned more than once
+func (v *exportVisitor) checkReassignedExports() {
+	names := make([]string, 0, len(v.assignSites))
+	for name, sites := range v.assignSites {
+		if len(sites) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sites := v.assignSites[name]
+		offsets := make([]string, len(sites))
+		for i, offset := range sites {
+			offsets[i] = strconv.Itoa(offset)
+		}
+		v.diagnostics = append(v.diagnostics, Diagnostic{
+			Offset:  sites[0],
+			Message: fmt.Sprintf("export %q is assigned %d times, at offsets %s", name, len(sites), strings.Join(offsets, ", ")),
+		})
+	}
+}
+
+// extendsExports reports whether expr is Object.assign(exports, ...)
+func (v *exportVisitor) extendsExports(expr js.IExpr) bool {
+	call, ok := expr.(*js.CallExpr)
+	return ok && v.isObjectAssign(call.X) && len(call.Args.List) > 0 &&
+		v.isExportsObject(call.Args.List[0].Value)
+}
+
+// offsetOf returns the offset of an expression in the source, or -1
+func (v *exportVisitor) offsetOf(expr js.IExpr) int {
+	var data []byte
+	switch lit := expr.(type) {
+	case *js.LiteralExpr:
+		data = lit.Data
+	case js.LiteralExpr:
+		data = lit.Data
+	}
+	offset := offsetOf(v.src, data)
+	if offset < 0 {
+		return -1
+	}
+	return v.base + offset
+}
+
+// extractLocalKeys exports the keys known so far of a local object, unless
+// it has been mutated dynamically
+func (v *exportVisitor) extractLocalKeys(ident *js.Var, via string) {
+	ident = binding(ident)
+	obj, ok := v.objectVars[ident]
+	if !ok || v.dynamicLocals[ident] {
+		return
+	}
+	// Remove the object while extracting to avoid cycles like ...out in out
+	delete(v.objectVars, ident)
+	defer func() { v.objectVars[ident] = obj }()
+	v.extractObjectKeys(obj, via)
+	for _, prop := range v.localProps[ident] {
+		v.addExport(prop, via)
+	}
+}
+
+// extractAttachedProps handles the `function f() {}; f.helper = 1;
+// module.exports = f` shape, where static properties assigned to the
+// default export at the top level are also exported by name.
+func (v *exportVisitor) extractAttachedProps(stmts []js.IStmt) {
+	props := make(map[string][]string)
+	defaultIdent := ""
+	for _, stmt := range stmts {
+		expr, ok := stmt.(*js.ExprStmt)
+		if !ok {
+			continue
+		}
+		bin, ok := expr.Value.(*js.BinaryExpr)
+		if !ok || bin.Op != js.EqToken {
+			continue
+		}
+		if v.isModuleExports(bin.X) {
+			// module.exports = f
+			defaultIdent = ""
+			if ident, ok := bin.Y.(*js.Var); ok {
+				defaultIdent = string(ident.Data)
+			}
+		} else if dot, ok := bin.X.(*js.DotExpr); ok {
+			// f.helper = ...
+			if ident, ok := dot.X.(*js.Var); ok && !v.isExportsIdent(ident) && !v.isModuleIdent(ident) {
+				if name := v.extractDotName(dot.Y); name != "" {
+					props[string(ident.Data)] = append(props[string(ident.Data)], name)
+				}
+			}
+		}
+	}
+	for _, name := range props[defaultIdent] {
+		v.addExport(name, "module-exports-object")
+	}
+}
+
+// extractDotName returns the property name of a dot expression, which can be
+// either *js.Var or js.LiteralExpr (no pointer)
+func (v *exportVisitor) extractDotName(expr js.IExpr) string {
+	if ident, ok := expr.(*js.Var); ok {
+		return string(ident.Data)
+	} else if lit, ok := expr.(js.LiteralExpr); ok {
+		return string(lit.Data)
+	}
+	return ""
+}
+
+// isObjectAssign reports whether expr is Object.assign
+func (v *exportVisitor) isObjectAssign(expr js.IExpr) bool {
+	dot, ok := expr.(*js.DotExpr)
+	if !ok || !v.isObjectIdent(dot.X) {
+		return false
+	}
+	return v.extractDotName(dot.Y) == "assign"
+}
+
 func (v *exportVisitor) isExportsIdent(expr js.IExpr) bool {
 	if ident, ok := expr.(*js.Var); ok {
-		return string(ident.Data) == "exports"
+		return string(ident.Data) == "exports" && !v.shadowed[binding(ident)]
 	}
 	return false
 }
 
 func (v *exportVisitor) isModuleIdent(expr js.IExpr) bool {
 	if ident, ok := expr.(*js.Var); ok {
-		return string(ident.Data) == "module"
+		if v.moduleAliases[binding(ident)] {
+			return true
+		}
+		return string(ident.Data) == "module" && !v.shadowed[binding(ident)]
 	}
 	return false
 }
@@ -289,6 +1089,13 @@ func (v *exportVisitor) isObjectIdent(expr js.IExpr) bool {
 	return false
 }
 
+func (v *exportVisitor) isReflectIdent(expr js.IExpr) bool {
+	if ident, ok := expr.(*js.Var); ok {
+		return string(ident.Data) == "Reflect"
+	}
+	return false
+}
+
 func (v *exportVisitor) isExportsField(expr js.IExpr) bool {
 	if ident, ok := expr.(*js.Var); ok {
 		return string(ident.Data) == "exports"
@@ -309,6 +1116,89 @@ func (v *exportVisitor) isDefinePropertyField(expr js.IExpr) bool {
 	return false
 }
 
+// isExportsObject reports whether expr refers to the exports object, either
+// through exports, module.exports or a tracked alias of them
+func (v *exportVisitor) isExportsObject(expr js.IExpr) bool {
+	if v.isExportsIdent(expr) || v.isModuleExports(expr) || v.isThisExports(expr) {
+		return true
+	}
+	if dot, ok := expr.(*js.DotExpr); ok && v.isGlobalExports(dot) {
+		return true
+	}
+	if ident, ok := expr.(*js.Var); ok {
+		return v.aliases[binding(ident)]
+	}
+	return false
+}
+
+// binding returns the declaration a variable refers to. Uses in nested
+// scopes are separate variables linked to their declaration.
+func binding(ident *js.Var) *js.Var {
+	for ident.Link != nil {
+		ident = ident.Link
+	}
+	return ident
+}
+
+// isThisExports reports whether expr is a `this` that refers to exports with
+// TreatThisAsExports, outside of any function or class with its own `this`
+func (v *exportVisitor) isThisExports(expr js.IExpr) bool {
+	if !v.opts.TreatThisAsExports || v.thisDepth > 0 {
+		return false
+	}
+	lit, ok := expr.(*js.LiteralExpr)
+	return ok && lit.TokenType == js.ThisToken
+}
+
+// trackWrapper records functions invoked with the module's `this`, like
+// `(function () { ... }).call(this)`. A plain `(function () { ... })()`
+// runs with the global object or undefined as `this` instead.
+func (v *exportVisitor) trackWrapper(call *js.CallExpr) {
+	dot, ok := unwrapGroup(call.X).(*js.DotExpr)
+	if !ok || len(call.Args.List) == 0 || call.Args.List[0].Rest {
+		return
+	}
+	if name := v.extractDotName(dot.Y); name != "call" && name != "apply" {
+		return
+	}
+	this, ok := call.Args.List[0].Value.(*js.LiteralExpr)
+	if !ok || this.TokenType != js.ThisToken || v.thisDepth > 0 {
+		return
+	}
+	if fn, ok := unwrapGroup(dot.X).(*js.FuncDecl); ok {
+		v.wrappers[fn] = true
+	}
+}
+
+// bindsThis reports whether n is a function or class with its own `this`.
+// Wrappers called with the module's `this` keep it.
+func (v *exportVisitor) bindsThis(n js.INode) bool {
+	switch n := n.(type) {
+	case *js.FuncDecl:
+		return !v.wrappers[n]
+	case *js.MethodDecl, *js.ClassDecl:
+		return true
+	}
+	return false
+}
+
+// isGlobalExports reports whether expr is the configured global, like
+// globalThis.MyLib or self.MyLib
+func (v *exportVisitor) isGlobalExports(dot *js.DotExpr) bool {
+	if v.opts.GlobalName == "" || v.extractDotName(dot.Y) != v.opts.GlobalName {
+		return false
+	}
+	ident, ok := dot.X.(*js.Var)
+	if !ok {
+		return false
+	}
+	switch string(ident.Data) {
+	case "globalThis", "self", "window", "global":
+		return true
+	}
+	return false
+}
+
 func (v *exportVisitor) isModuleExports(expr js.IExpr) bool {
 	if dot, ok := expr.(*js.DotExpr); ok {
 		return v.isModuleIdent(dot.X) && v.isExportsField(dot.Y)
@@ -317,28 +1207,104 @@ func (v *exportVisitor) isModuleExports(expr js.IExpr) bool {
 }
 
 func (v *exportVisitor) extractStringLiteral(expr js.IExpr) string {
-	if lit, ok := expr.(*js.LiteralExpr); ok {
-		data := string(lit.Data)
-		// Remove quotes and unescape
-		if len(data) >= 2 {
-			if (data[0] == '"' && data[len(data)-1] == '"') ||
-				(data[0] == '\'' && data[len(data)-1] == '\'') {
-				unquoted := data[1 : len(data)-1]
-				return unescapeJSString(unquoted)
-			}
+	value, _ := stringLiteral(expr)
+	return value
+}
+
+// extractStaticString extracts a string literal or a string constant
+func (v *exportVisitor) extractStaticString(expr js.IExpr) string {
+	if ident, ok := expr.(*js.Var); ok {
+		return v.constants[binding(ident)]
+	}
+	return v.extractStringLiteral(expr)
+}
+
+// extractPropertyKey extracts a property key passed as a value, like the name
+// in Object.defineProperty(exports, name, ...), which can be a string, a
+// string constant or a number. Dynamic keys resolve to "".
+func (v *exportVisitor) extractPropertyKey(expr js.IExpr) string {
+	if value, ok := templateString(expr); ok {
+		return value
+	}
+	if value, ok := numberString(expr); ok {
+		return value
+	}
+	return v.extractStaticString(expr)
+}
+
+// numberString converts a number literal to the string it becomes as a
+// property key, like 0x10 to "16"
+func numberString(expr js.IExpr) (string, bool) {
+	lit, ok := expr.(*js.LiteralExpr)
+	if !ok || !js.IsNumeric(lit.TokenType) {
+		return "", false
+	}
+	data := strings.ReplaceAll(string(lit.Data), "_", "")
+	var f float64
+	if lit.TokenType == js.DecimalToken {
+		value, err := strconv.ParseFloat(data, 64)
+		if err != nil {
+			return "", false
+		}
+		f = value
+	} else {
+		value, err := strconv.ParseUint(data, 0, 64)
+		if err != nil {
+			return "", false
 		}
+		f = float64(value)
 	}
-	return ""
+	// Match JavaScript's Number.prototype.toString for the common cases
+	if f == 0 || (f >= 1e-6 && f < 1e21) {
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	}
+	value := strconv.FormatFloat(f, 'g', -1, 64)
+	value = strings.Replace(value, "e-0", "e-", 1)
+	return strings.Replace(value, "e+0", "e+", 1), true
+}
+
+// stringLiteral returns the unescaped value of a string literal
+func stringLiteral(expr js.IExpr) (string, bool) {
+	lit, ok := expr.(*js.LiteralExpr)
+	if !ok {
+		return "", false
+	}
+	data := string(lit.Data)
+	// Remove quotes and unescape
+	if len(data) >= 2 {
+		if (data[0] == '"' && data[len(data)-1] == '"') ||
+			(data[0] == '\'' && data[len(data)-1] == '\'') {
+			unquoted := data[1 : len(data)-1]
+			return unescapeJSString(unquoted), true
+		}
+	}
+	return "", false
 }
 
-// unescapeJSString unescapes JavaScript string escape sequences
+// templateString returns the value of a template literal without
+// substitutions or tag, like `name`
+func templateString(expr js.IExpr) (string, bool) {
+	tmpl, ok := expr.(*js.TemplateExpr)
+	if !ok || tmpl.Tag != nil || len(tmpl.List) > 0 {
+		return "", false
+	}
+	data := string(tmpl.Tail)
+	if len(data) < 2 || data[0] != '`' || data[len(data)-1] != '`' {
+		return "", false
+	}
+	return unescapeJSString(data[1 : len(data)-1]), true
+}
+
+// unescapeJSString unescapes JavaScript string escape sequences. Malformed
+// escapes are kept as-is rather than failing, so arbitrary input never panics.
 func unescapeJSString(s string) string {
 	var result []rune
 	i := 0
 	for i < len(s) {
 		if s[i] != '\\' {
-			result = append(result, rune(s[i]))
-			i++
+			r, size := utf8.DecodeRuneInString(s[i:])
+			result = append(result, r)
+			i += size
 			continue
 		}
 
@@ -367,41 +1333,19 @@ func unescapeJSString(s string) string {
 		case 'v':
 			result = append(result, '\v')
 			i += 2
-		case '0':
-			// Octal or null
-			if i+2 < len(s) && s[i+2] >= '0' && s[i+2] <= '7' {
-				// Octal escape \OOO
-				end := i + 2
-				for end < len(s) && end < i+4 && s[end] >= '0' && s[end] <= '7' {
-					end++
-				}
-				octal := s[i+1 : end]
-				var val int
-				fmt.Sscanf(octal, "%o", &val)
-				result = append(result, rune(val))
-				i = end
-			} else {
-				result = append(result, '\x00')
-				i += 2
-			}
-		case '1', '2', '3', '4', '5', '6', '7':
-			// Octal escape
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Octal escape \O, \OO or \OOO (\0 alone is null)
 			end := i + 1
 			for end < len(s) && end < i+4 && s[end] >= '0' && s[end] <= '7' {
 				end++
 			}
-			octal := s[i+1 : end]
-			var val int
-			fmt.Sscanf(octal, "%o", &val)
+			val, _ := strconv.ParseUint(s[i+1:end], 8, 32)
 			result = append(result, rune(val))
 			i = end
 		case 'x':
 			// Hex escape \xHH
-			if i+3 < len(s) {
-				hex := s[i+2 : i+4]
-				var val int
-				fmt.Sscanf(hex, "%x", &val)
-				result = append(result, rune(val))
+			if val, ok := parseHexRune(s, i+2, i+4); ok {
+				result = append(result, val)
 				i += 4
 			} else {
 				result = append(result, 'x')
@@ -410,27 +1354,22 @@ func unescapeJSString(s string) string {
 		case 'u':
 			// Unicode escape \uHHHH or \u{HHHHHH}
 			if i+2 < len(s) && s[i+2] == '{' {
-				// \u{HHHHHH}
-				end := i + 3
-				for end < len(s) && s[end] != '}' {
-					end++
+				end := strings.IndexByte(s[i+3:], '}')
+				if end < 0 {
+					result = append(result, 'u')
+					i += 2
+					break
 				}
-				if end < len(s) {
-					hex := s[i+3 : end]
-					var val int
-					fmt.Sscanf(hex, "%x", &val)
-					result = append(result, rune(val))
+				end += i + 3
+				if val, ok := parseHexRune(s, i+3, end); ok {
+					result = append(result, val)
 					i = end + 1
 				} else {
 					result = append(result, 'u')
 					i += 2
 				}
-			} else if i+5 < len(s) {
-				// \uHHHH
-				hex := s[i+2 : i+6]
-				var val int
-				fmt.Sscanf(hex, "%x", &val)
-				result = append(result, rune(val))
+			} else if val, ok := parseHexRune(s, i+2, i+6); ok {
+				result = append(result, val)
 				i += 6
 			} else {
 				result = append(result, 'u')
@@ -447,20 +1386,37 @@ func unescapeJSString(s string) string {
 			i += 2
 		default:
 			// Unknown escape, keep the character
-			result = append(result, rune(s[i+1]))
-			i += 2
+			r, size := utf8.DecodeRuneInString(s[i+1:])
+			result = append(result, r)
+			i += 1 + size
 		}
 	}
 	return string(result)
 }
 
+// parseHexRune parses s[start:end] as a hexadecimal code point, reporting
+// false if the range is out of bounds, empty or not a valid code point.
+func parseHexRune(s string, start, end int) (rune, bool) {
+	if start >= end || end > len(s) {
+		return 0, false
+	}
+	val, err := strconv.ParseUint(s[start:end], 16, 32)
+	if err != nil || val > unicode.MaxRune {
+		return 0, false
+	}
+	return rune(val), true
+}
+
 func (v *exportVisitor) extractPropertyName(name *js.PropertyName) string {
 	if name == nil || !name.IsSet() {
 		return ""
 	}
 
-	// Check if it's a computed property
+	// Check if it's a computed property, like ["name"] or [`name`]
 	if name.Computed != nil {
+		if value, ok := templateString(name.Computed); ok {
+			return value
+		}
 		return v.extractStringLiteral(name.Computed)
 	}
 
@@ -475,20 +1431,20 @@ func (v *exportVisitor) extractPropertyName(name *js.PropertyName) string {
 	return data
 }
 
-// extractShebang returns the shebang line (if present) and the code without it.
+// extractShebang returns the shebang line (if present) and the code without
+// it. Blank lines and byte order marks before the shebang are kept with it.
 func extractShebang(code string) (string, string) {
-	lines := bytes.Split([]byte(code), []byte("\n"))
-	for i, line := range lines {
-		trimmed := bytes.TrimSpace(line)
-		if len(trimmed) == 0 {
-			continue
-		}
-		if len(trimmed) >= 2 && trimmed[0] == '#' && trimmed[1] == '!' {
-			shebang := string(line) + "\n"
-			rest := string(bytes.Join(lines[i+1:], []byte("\n")))
-			return shebang, rest
-		}
-		break
+	rest := strings.TrimLeftFunc(code, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\ufeff'
+	})
+	if !strings.HasPrefix(rest, "#!") {
+		return "", code
+	}
+	end := len(code) - len(rest)
+	newline := strings.IndexByte(rest, '\n')
+	if newline < 0 {
+		return code + "\n", ""
 	}
-	return "", code
+	end += newline + 1
+	return code[:end], code[end:]
 }
@@ -6,6 +6,8 @@ import (
 
 	"github.com/matryer/is"
 	"github.com/matthewmueller/cjs"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
 )
 
 func exportsEqual(t testing.TB, actual, expect []string) {
@@ -26,6 +28,20 @@ func TestShebang(t *testing.T) {
 	})
 }
 
+func TestShebangAfterBOM(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", "\n\ufeff#!/usr/bin/env node\nexports.foo = 'bar';\n")
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"foo",
+	})
+	exports, err = cjs.ParseExports("test.js", "#!/bin/sh\n/*\n#!/usr/bin/env node\n*/\nexports.foo = 'bar';\n")
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"foo",
+	})
+}
+
 func TestModuleExports(t *testing.T) {
 	is := is.New(t)
 	exports, err := cjs.ParseExports("test.js", `
@@ -96,6 +112,19 @@ func TestModuleExportsReexportSpread(t *testing.T) {
 	})
 }
 
+func TestModuleExportsReexportSpreadParenthesized(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		module.exports = {
+			...require(('dep1')),
+			c: d,
+		};
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	exportsEqual(t, result.Exports, []string{"c", "default"})
+	is.Equal(result.Reexports, []cjs.Reexport{{Specifier: "dep1"}})
+}
+
 func TestModuleAssign(t *testing.T) {
 	is := is.New(t)
 	exports, err := cjs.ParseExports("test.js", `
@@ -317,3 +346,629 @@ func TestGetterOptOuts(t *testing.T) {
 	// The second defineProperty should mark 'a' as an unsafe getter, preventing export
 	exportsEqual(t, exports, []string{})
 }
+
+func FuzzParseExports(f *testing.F) {
+	f.Add(`exports.foo = 'bar';`)
+	f.Add(`module.exports = { a, b: c, 'd': e };`)
+	f.Add(`Object.defineProperty(exports, "a", { get () { return q.p; } });`)
+	f.Add(`exports["\x"] = 1;`)
+	f.Add(`exports["\x4"] = 1;`)
+	f.Add(`exports["\u{1F310"] = 1;`)
+	f.Add(`exports["\u{"] = 1;`)
+	f.Add(`exports["\u12"] = 1;`)
+	f.Add(`exports["\u{FFFFFFFFFF}"] = 1;`)
+	f.Add(`exports["\0"] = 1;`)
+	f.Add(`exports["\377\\"] = 1;`)
+	f.Add("#!/usr/bin/env node\nexports.a = 1;")
+	f.Fuzz(func(t *testing.T, code string) {
+		// ParseExports must never panic, regardless of the input
+		cjs.ParseExports("fuzz.js", code)
+	})
+}
+
+func TestAttachedProps(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		function f() {}
+		f.helper = 1;
+		f['ignored'] = 2;
+		other.prop = 3;
+		module.exports = f;
+		f.later = function () {};
+		function g() { f.nested = 4; }
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"default",
+		"helper",
+		"later",
+	})
+}
+
+func TestReflectDefineProperty(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		Reflect.defineProperty(exports, "x", { value: 1 });
+		Reflect.defineProperty(module.exports, "y", { enumerable: true, get: function () { return q.y; } });
+		Reflect.defineProperty(exports, "z", { enumerable: true, get: function () { return dynamic(); } });
+		Reflect.defineProperty(other, "w", { value: 1 });
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"x",
+		"y",
+	})
+}
+
+func TestParseExportsAST(t *testing.T) {
+	is := is.New(t)
+	ast, err := js.Parse(parse.NewInputString(`
+		exports.a = 1;
+		module.exports.b = 2;
+		Object.defineProperty(exports, "c", { value: 3 });
+	`), js.Options{})
+	is.NoErr(err)
+	exports, err := cjs.ParseExportsAST(ast)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+	})
+}
+
+func TestAliasedDefineProperty(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		var e = exports;
+		const m = module.exports;
+		Object.defineProperty(e, "x", { value: 1 });
+		Object.defineProperty(m, "y", { value: 2 });
+		e.z = 3;
+		Object.defineProperty(notAlias, "w", { value: 4 });
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"x",
+		"y",
+		"z",
+	})
+}
+
+func TestAliasScope(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		var e = exports;
+		e.a = 1;
+		function g(e) { e.b = 2; }
+		function h() { e.c = 3; }
+		e = {};
+		e.d = 4;
+		e = module.exports;
+		e.f = 5;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"c",
+		"f",
+	})
+}
+
+func TestModuleExportsObjectAssign(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		module.exports.a = a;
+		module.exports = Object.assign(module.exports, { b, c: d }, { 'e': f });
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+		"default",
+		"e",
+	})
+}
+
+func TestGetterConstAlias(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		Object.defineProperty(exports, 'a', {
+			enumerable: true,
+			get: function () {
+				const v = ns.val;
+				return v;
+			}
+		});
+		Object.defineProperty(exports, 'b', {
+			enumerable: true,
+			get: function () {
+				const n = ns;
+				const v = n;
+				return v.x;
+			}
+		});
+		Object.defineProperty(exports, 'c', {
+			enumerable: true,
+			get () {
+				const v = dynamic();
+				return v;
+			}
+		});
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+	})
+}
+
+func TestModuleExportsConditional(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		module.exports = env ? { dev } : { prod };
+		module.exports = env ? { 'a': a } : fallback;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"default",
+		"dev",
+		"prod",
+	})
+}
+
+func TestDefinePropertyUndefinedValue(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		Object.defineProperty(exports, "a", { value: void 0 });
+		Object.defineProperty(exports, "b", { value: undefined });
+		Object.defineProperty(exports, "c", { enumerable: true });
+		Object.defineProperty(exports, "d", { enumerable: true, configurable: true, writable: true });
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+	})
+}
+
+func TestIfGuard(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		if (!exports.foo) exports.foo = impl;
+		if (!module.exports.bar) { module.exports.bar = impl; }
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"bar",
+		"foo",
+	})
+}
+
+func TestLogicalOrGuard(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		exports.foo = exports.foo || impl;
+		exports.foo = exports.foo || other;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"foo",
+	})
+}
+
+func TestExportsPassedToIIFE(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		(function (exports) { exports.a = 1; })(exports);
+		(function (module, exports) { module.exports.b = 2; exports.c = 3; })(module, exports);
+		(function (e, m) { e.d = 4; m.exports.e = 5; })(exports, module);
+		((exports) => { exports.f = 6; })(module.exports);
+		(function (exports) { exports.notExported = 7; })({});
+		(function (module) { module.exports = 8; })({});
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+		"d",
+		"e",
+		"f",
+	})
+}
+
+func TestIIFEParameterScope(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		(function (e, m) { e.a = 1; m.exports.b = 2; })(exports, module);
+		function f(e, m) { e.notExport = 3; m.exports.notExport2 = 4; }
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+	})
+}
+
+func TestModuleExportsArrowIIFE(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		module.exports = (() => ({ a, b: 2 }))();
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"default",
+	})
+}
+
+func TestUMD(t *testing.T) {
+	is := is.New(t)
+	code := `
+		(function (global, factory) {
+			typeof exports === 'object' && typeof module !== 'undefined' ? factory(exports) :
+			typeof define === 'function' && define.amd ? define(['exports'], factory) :
+			(global = global || self, factory(global.lib = {}));
+		})(this, function (e) {
+			'use strict';
+			e.foo = 1;
+			e.bar = 2;
+			function h(e) { e.notExport = 3; }
+		});
+		function h(e) { e.notExport2 = 4; }
+	`
+	exports, err := cjs.ParseExports("test.js", code)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.DetectUMD = true
+	exports, err = cjs.ParseExportsWith("test.js", code, opts)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"bar",
+		"foo",
+	})
+}
+
+func TestMergeExports(t *testing.T) {
+	is := is.New(t)
+	index, err := cjs.ParseExports("index.js", `
+		exports.a = 1;
+		module.exports.b = 2;
+		module.exports = Object.assign(module.exports, require("./sub"));
+	`)
+	is.NoErr(err)
+	sub, err := cjs.ParseExports("sub.js", `
+		exports.b = 2;
+		exports.c = 3;
+		module.exports = exports;
+	`)
+	is.NoErr(err)
+	is.Equal(cjs.MergeExports(index, sub), []string{"a", "b", "c", "default"})
+	is.Equal(cjs.MergeExports([]string{"a"}, sub), []string{"a", "b", "c"})
+	is.Equal(cjs.MergeExports(nil), []string{})
+}
+
+func TestSequenceGetter(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		Object.defineProperty(exports, "a", { enumerable: true, get: function () { return foo.bar, foo.baz; } });
+		Object.defineProperty(exports, "b", { enumerable: true, get: function () { return foo.bar, compute(); } });
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+	})
+}
+
+func TestArrowGetter(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		Object.defineProperty(exports, "a", { enumerable: true, get: () => ns.val });
+		Object.defineProperty(exports, "b", { enumerable: true, get: () => { return ns.other; } });
+		Object.defineProperty(exports, "c", { enumerable: true, get: () => require("./c").c });
+		Object.defineProperty(exports, "d", { enumerable: true, get: () => compute() });
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c"})
+	is.Equal(result.Details[2], cjs.Export{Name: "c", ReexportFrom: "./c", ReexportName: "c", Via: "getter"})
+}
+
+func TestSwitchExports(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		switch (env) {
+			case 'prod':
+				exports.api = prodApi;
+				break;
+			case 'test':
+				module.exports = testApi;
+				break;
+			default:
+				exports.api = devApi;
+		}
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"api", "default"})
+	is.True(result.HasDefault)
+}
+
+func TestDynamicKey(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		for (var p in m) if (!exports.hasOwnProperty(p)) exports[p] = m[p];
+		exports[p + "x"] = 1;
+		exports[""] = 2;
+		const EMPTY = "";
+		exports[EMPTY] = 3;
+		exports.a = 4;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+	})
+	opts := cjs.DefaultParseOptions()
+	opts.Resolve = func(specifier string) ([]string, error) {
+		return []string{"", "b"}, nil
+	}
+	exports, err = cjs.ParseExportsWith("test.js", `module.exports = require("./b")`, opts)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"b",
+		"default",
+	})
+}
+
+func TestComputedTemplateKeys(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", "module.exports = { [`${prefix}Name`]: value, [`staticName`]: value, [tag`tagged`]: value };")
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"default",
+		"staticName",
+	})
+}
+
+func TestDestructuringAssignment(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		({ a: module.exports.a, b: exports.b, c: exports["c"] = 1, d: { e: exports.e }, f } = source);
+		[exports.g, , ...exports.h] = list;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+		"e",
+		"g",
+		"h",
+	})
+}
+
+func TestGlobalName(t *testing.T) {
+	is := is.New(t)
+	code := `
+		(() => {
+			globalThis.MyLib = { a, b };
+			globalThis.MyLib.c = 3;
+			self.MyLib["d"] = 4;
+			globalThis.Other = { e };
+		})();
+	`
+	exports, err := cjs.ParseExports("test.js", code)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.GlobalName = "MyLib"
+	exports, err = cjs.ParseExportsWith("test.js", code, opts)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+		"d",
+		"default",
+	})
+}
+
+func TestAssembledDescriptor(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		var D = { enumerable: false };
+		var E = { enumerable: true };
+		function g() { var E = { enumerable: false }; }
+		Object.defineProperty(exports, "hidden", Object.assign({ get() { return y.hidden } }, D));
+		Object.defineProperty(exports, "shown", Object.assign({ get() { return y.shown } }, D, E));
+		Object.defineProperty(exports, "value", Object.assign({}, { value: 1 }));
+		Object.defineProperty(exports, "unknown", Object.assign({ get() { return y.unknown } }, unknown));
+		var V = { value: 2 };
+		Object.defineProperty(exports, "shared", V);
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"shared",
+		"shown",
+		"value",
+	})
+}
+
+func TestSpreadLocalObject(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		var out = { a: 1 };
+		out.b = 2;
+		out["c"] = 3;
+		var dyn = {};
+		dyn.d = 4;
+		dyn[key] = 5;
+		var swapped = { e: 5 };
+		swapped = other;
+		function g() { var out = {}; out.z = 1; }
+		module.exports = { ...out, ...dyn, ...swapped, ...unknown, f };
+		out.late = 6;
+	`)
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"b",
+		"c",
+		"default",
+		"f",
+	})
+}
+
+func TestNestedBlockExports(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		{ exports.a = 1; }
+		loop: { exports.b = 2; { exports.a = 3; } }
+		{
+			module.exports = { c: 3, a: 4 };
+		}
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "default"})
+	is.True(result.HasDefault)
+}
+
+func TestModuleExportsResetThenPopulate(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		module.exports = {};
+		module.exports.x = 1;
+		module.exports.y = 2;
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"default", "x", "y"})
+	is.True(result.HasDefault)
+	is.Equal(len(result.Diagnostics), 0)
+}
+
+func TestChainedDefaultAssignment(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `exports.default = exports.foo = module.exports.bar = thing;`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"bar", "default", "foo"})
+	// exports.default is a named export, not module.exports
+	is.True(!result.HasDefault)
+}
+
+func TestIsExported(t *testing.T) {
+	is := is.New(t)
+	code := `
+		exports.a = 1;
+		exports.b = 2;
+		Object.defineProperty(exports, "b", { get() { return compute(); } });
+	`
+	exported, err := cjs.IsExported("test.js", code, "a")
+	is.NoErr(err)
+	is.True(exported)
+	exported, err = cjs.IsExported("test.js", code, "b")
+	is.NoErr(err)
+	is.True(!exported)
+	exported, err = cjs.IsExported("test.js", code, "default")
+	is.NoErr(err)
+	is.True(!exported)
+	exported, err = cjs.IsExported("test.js", `module.exports = function () {};`, "default")
+	is.NoErr(err)
+	is.True(exported)
+	exported, err = cjs.IsExported("test.js", `exports.default = 1;`, "default")
+	is.NoErr(err)
+	is.True(exported)
+	_, err = cjs.IsExported("test.js", `exports.a = ;`, "a")
+	is.True(err != nil)
+}
+
+func TestDefinePropertyNumericAndConstantNames(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		const NAME = "fromConst";
+		Object.defineProperty(exports, 0, { value: 1 });
+		Object.defineProperty(exports, 0x10, { value: 2 });
+		Object.defineProperty(exports, 1.50, { value: 3 });
+		Object.defineProperty(exports, 1_000, { value: 4 });
+		Object.defineProperty(exports, NAME, { value: 5 });
+		Object.defineProperty(exports, `+"`tmpl`"+`, { value: 6 });
+		Object.defineProperty(exports, dynamic, { value: 7 });
+		Object.defineProperty(exports, 10n, { value: 8 });
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"0", "1.5", "1000", "16", "fromConst", "tmpl"})
+}
+
+func TestNestedExportsProperty(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		exports.config = exports.config || {};
+		exports.config.timeout = 5;
+		module.exports.config["retries"] = 3;
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"config"})
+}
+
+func TestArrowModuleBody(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		((exports) => { exports.a = 1; exports.b = 2; })(exports);
+		((e, m) => { e.c = 3; m.exports.d = 4; })(module.exports, module);
+		((e) => { e.f = 5; }).call(this, exports);
+		((exports) => { exports.notExported = 6; })({});
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "d", "f"})
+}
+
+func TestDefinePropertiesAlias(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		var tgt = exports;
+		Object.defineProperties(tgt, {
+			a: { value: 1 },
+			"b": { enumerable: true, get: function () { return dep.b; } },
+			["c"]: { value: 3 },
+			d: { get: function () { return compute(); } },
+			e: descriptor,
+		});
+		Object.defineProperties(other, { f: { value: 6 } });
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c"})
+	is.Equal(result.Details[1], cjs.Export{Name: "b", Via: "getter"})
+}
+
+func TestOptionalChainGuard(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		module?.exports && (module.exports.x = 1);
+		typeof exports === "object" && exports?.y;
+		module?.exports?.z;
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"x"})
+	is.Equal(result.HasDefault, false)
+	is.Equal(len(result.Diagnostics), 0)
+}
+
+func TestSpreadExports(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		exports.foo = 1;
+		module.exports = { ...exports, extra: 1 };
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"default", "extra", "foo"})
+	is.Equal(len(result.Diagnostics), 0)
+	// Reading the exports doesn't define any
+	result, err = cjs.Parse("test.js", `
+		const all = { ...exports, bar: 1 };
+		const more = { ...module.exports };
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+}
@@ -0,0 +1,140 @@
+package cjs
+
+import (
+	"sort"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// scanExports finds exports like `exports.foo =`, `module.exports.foo =`,
+// `exports["foo"] =` and `module.exports =` by scanning tokens, for code
+// the parser rejects. It's less precise than parsing and stops at the first
+// token the lexer doesn't understand.
+func scanExports(code string, opts ParseOptions) *Result {
+	lexer := js.NewLexer(parse.NewInputString(code))
+	var exports []string
+	hasDefault := false
+	var tokens []scanToken // Significant tokens so far
+	for {
+		tt, data := lexer.Next()
+		switch tt {
+		case js.ErrorToken:
+			return scanResult(exports, hasDefault, opts)
+		case js.WhitespaceToken, js.LineTerminatorToken, js.CommentToken, js.CommentLineTerminatorToken:
+			continue
+		case js.DivToken, js.DivEqToken:
+			if len(tokens) == 0 || !endsExpression(tokens[len(tokens)-1].tt) {
+				tt, data = lexer.RegExp()
+			}
+		}
+		tokens = append(tokens, scanToken{tt, string(data)})
+		if tt != js.EqToken {
+			continue
+		}
+		// Look back from the = for the exports patterns
+		switch name, ok := matchExportsTarget(tokens[:len(tokens)-1]); {
+		case ok && name == "":
+			hasDefault = true
+		case ok:
+			exports = append(exports, name)
+		}
+	}
+}
+
+type scanToken struct {
+	tt   js.TokenType
+	data string
+}
+
+// matchExportsTarget matches the tokens before an = against exports.foo,
+// exports["foo"], module.exports.foo and module.exports, returning "" for
+// module.exports
+func matchExportsTarget(tokens []scanToken) (string, bool) {
+	// Match the last tokens against a pattern, where "" matches any
+	// identifier or string
+	match := func(pattern ...string) []scanToken {
+		if len(tokens) < len(pattern) {
+			return nil
+		}
+		tail := tokens[len(tokens)-len(pattern):]
+		for i, want := range pattern {
+			if want == "" {
+				if !js.IsIdentifierName(tail[i].tt) && tail[i].tt != js.StringToken {
+					return nil
+				}
+			} else if tail[i].data != want {
+				return nil
+			}
+		}
+		// The target must not be a property of something else, like a.exports.foo
+		if len(tokens) > len(pattern) && tokens[len(tokens)-len(pattern)-1].tt == js.DotToken {
+			return nil
+		}
+		return tail
+	}
+	if tail := match("module", ".", "exports", ".", ""); tail != nil && tail[4].tt != js.StringToken {
+		return tail[4].data, true
+	} else if tail := match("module", ".", "exports", "[", "", "]"); tail != nil && tail[4].tt == js.StringToken {
+		name, ok := stringLiteral(&js.LiteralExpr{TokenType: js.StringToken, Data: []byte(tail[4].data)})
+		return name, ok && name != ""
+	} else if tail := match("module", ".", "exports"); tail != nil {
+		return "", true
+	} else if tail := match("exports", ".", ""); tail != nil && tail[2].tt != js.StringToken {
+		return tail[2].data, true
+	} else if tail := match("exports", "[", "", "]"); tail != nil && tail[2].tt == js.StringToken {
+		name, ok := stringLiteral(&js.LiteralExpr{TokenType: js.StringToken, Data: []byte(tail[2].data)})
+		return name, ok && name != ""
+	}
+	return "", false
+}
+
+// endsExpression reports whether a / after the token is a division rather
+// than the start of a regular expression
+func endsExpression(tt js.TokenType) bool {
+	if js.IsIdentifier(tt) || js.IsNumeric(tt) {
+		return true
+	}
+	switch tt {
+	case js.StringToken, js.RegExpToken, js.TemplateToken, js.TemplateEndToken,
+		js.CloseParenToken, js.CloseBracketToken, js.CloseBraceToken,
+		js.ThisToken, js.TrueToken, js.FalseToken, js.NullToken:
+		return true
+	}
+	return false
+}
+
+// scanResult builds the result of scanning tokens like parseAST does
+func scanResult(order []string, hasDefault bool, opts ParseOptions) *Result {
+	found := make(map[string]bool)
+	exports := make([]string, 0, len(order)+1)
+	for _, name := range order {
+		if found[name] {
+			continue
+		}
+		found[name] = true
+		if name == "__esModule" && opts.ExcludeESModuleFlag {
+			continue
+		}
+		exports = append(exports, name)
+	}
+	if hasDefault && !opts.ExcludeSynthesizedDefault && !found["default"] {
+		exports = append(exports, "default")
+	}
+	if !opts.PreserveOrder {
+		sort.Strings(exports)
+	}
+	details := make([]Export, len(exports))
+	for i, name := range exports {
+		details[i] = Export{Name: name}
+		if found[name] {
+			details[i].Via = "exports-assign"
+		}
+	}
+	return &Result{
+		Exports:     exports,
+		HasDefault:  hasDefault,
+		HasESModule: found["__esModule"],
+		Details:     details,
+	}
+}
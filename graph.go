@@ -0,0 +1,76 @@
+package cjs
+
+import (
+	"fmt"
+)
+
+// BuildExportGraph parses the entry module and the modules it statically
+// requires, recursively, and returns the exports of each module by path.
+// Re-exports are expanded through the graph. Resolve can return an empty path
+// to skip a module, like a Node.js built-in. In a cycle, a module's exports
+// are only known once it's been parsed, so a module re-exporting one that's
+// still being parsed doesn't include its exports.
+func BuildExportGraph(entry string, read func(path string) (string, error), resolve func(from, req string) (string, error)) (map[string][]string, error) {
+	builder := &graphBuilder{
+		read:     read,
+		resolve:  resolve,
+		graph:    make(map[string][]string),
+		visiting: make(map[string]bool),
+	}
+	if _, err := builder.visit(entry); err != nil {
+		return nil, err
+	}
+	return builder.graph, nil
+}
+
+type graphBuilder struct {
+	read     func(path string) (string, error)
+	resolve  func(from, req string) (string, error)
+	graph    map[string][]string
+	visiting map[string]bool // Modules being parsed, to break cycles
+}
+
+// visit parses the module at path and returns its exports
+func (b *graphBuilder) visit(path string) ([]string, error) {
+	if exports, ok := b.graph[path]; ok {
+		return exports, nil
+	} else if b.visiting[path] {
+		return nil, nil
+	}
+	b.visiting[path] = true
+	defer delete(b.visiting, path)
+
+	code, err := b.read(path)
+	if err != nil {
+		return nil, fmt.Errorf("cjs: unable to read %s: %w", path, err)
+	}
+	opts := DefaultParseOptions()
+	opts.Resolve = func(specifier string) ([]string, error) {
+		child, err := b.resolve(path, specifier)
+		if err != nil || child == "" {
+			return nil, err
+		}
+		return b.visit(child)
+	}
+	result, err := Parse(path, code, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Visit requires that weren't resolved while parsing, like
+	// `var dep = require("dep")` or module.exports = { ...require("dep") }
+	for _, specifier := range result.Requires {
+		child, err := b.resolve(path, specifier)
+		if err != nil {
+			return nil, err
+		} else if child == "" {
+			continue
+		}
+		if _, err := b.visit(child); err != nil {
+			return nil, err
+		}
+	}
+
+	b.graph[path] = result.Exports
+	return result.Exports, nil
+}
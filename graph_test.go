@@ -0,0 +1,58 @@
+package cjs_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestBuildExportGraph(t *testing.T) {
+	is := is.New(t)
+	files := map[string]string{
+		"/index.js": `
+			__exportStar(require("./a"), exports);
+			exports.main = 1;
+		`,
+		"/a.js": `
+			var util = require("./util");
+			var fs = require("fs");
+			exports.a = util.helper;
+			__exportStar(require("./b"), exports);
+		`,
+		"/b.js": `
+			exports.b = 2;
+			__exportStar(require("./a"), exports);
+		`,
+		"/util.js": `
+			exports.helper = 3;
+		`,
+	}
+	read := func(p string) (string, error) {
+		code, ok := files[p]
+		if !ok {
+			return "", fmt.Errorf("not found")
+		}
+		return code, nil
+	}
+	resolve := func(from, req string) (string, error) {
+		if !strings.HasPrefix(req, ".") {
+			return "", nil
+		}
+		return path.Join(path.Dir(from), req) + ".js", nil
+	}
+	graph, err := cjs.BuildExportGraph("/index.js", read, resolve)
+	is.NoErr(err)
+	is.Equal(graph, map[string][]string{
+		"/index.js": {"a", "b", "main"},
+		"/a.js":     {"a", "b"},
+		"/b.js":     {"b"},
+		"/util.js":  {"helper"},
+	})
+
+	_, err = cjs.BuildExportGraph("/missing.js", read, resolve)
+	is.Equal(err.Error(), "cjs: unable to read /missing.js: not found")
+}
@@ -0,0 +1,103 @@
+package cjs
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// reservedWords can't be used as binding identifiers in strict module code
+var reservedWords = map[string]bool{
+	"await": true, "break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "implements": true, "import": true,
+	"in": true, "instanceof": true, "interface": true, "let": true,
+	"new": true, "null": true, "package": true, "private": true,
+	"protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true,
+	"with": true, "yield": true,
+}
+
+// IsValidIdentifier reports whether name can be used as a binding
+// identifier in an ES module, e.g. `export const name = ...`
+func IsValidIdentifier(name string) bool {
+	return isIdentifierName(name) && !reservedWords[name]
+}
+
+// isIdentifierName reports whether name can be written without quotes as a
+// property or import name, which includes reserved words like class
+func isIdentifierName(name string) bool {
+	if name == "" || !utf8.ValidString(name) {
+		return false
+	}
+	for i, r := range name {
+		if i == 0 {
+			if !isIdentifierStart(r) {
+				return false
+			}
+			continue
+		}
+		if !isIdentifierPart(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '$' || r == '_' || unicode.IsLetter(r) || unicode.Is(unicode.Nl, r)
+}
+
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) ||
+		r == '\u200c' || r == '\u200d' ||
+		unicode.In(r, unicode.Mn, unicode.Mc, unicode.Nd, unicode.Pc)
+}
+
+// isIdentifierByte reports whether b may be part of an identifier in source,
+// counting every byte of a multibyte character
+func isIdentifierByte(b byte) bool {
+	return b >= utf8.RuneSelf || isIdentifierPart(rune(b))
+}
+
+// quoteJS quotes s as a JavaScript string literal. Unlike strconv.Quote, it
+// only uses escapes that JavaScript understands, writing characters outside
+// the Basic Multilingual Plane as surrogate pairs.
+func quoteJS(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\u2028', '\u2029':
+			fmt.Fprintf(&sb, `\u%04X`, r)
+		default:
+			switch {
+			case r < 0x20 || r == 0x7F:
+				fmt.Fprintf(&sb, `\x%02X`, r)
+			case unicode.IsPrint(r):
+				sb.WriteRune(r)
+			case r > 0xFFFF:
+				high, low := utf16.EncodeRune(r)
+				fmt.Fprintf(&sb, `\u%04X\u%04X`, high, low)
+			default:
+				fmt.Fprintf(&sb, `\u%04X`, r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
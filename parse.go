@@ -0,0 +1,260 @@
+package cjs
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// ParseOptions configures Parse
+type ParseOptions struct {
+	// Resolve returns the named exports of a required module. When set, star
+	// re-exports like `for (var p in m) exports[p] = m[p]` where m is a
+	// require(specifier) result and top-level module.exports = require(...)
+	// re-exports are expanded to the resolved names.
+	Resolve func(specifier string) ([]string, error)
+	// ExcludeESModuleFlag leaves the __esModule interop flag out of Exports.
+	// HasESModule is set either way.
+	ExcludeESModuleFlag bool
+	// ExcludeSynthesizedDefault leaves "default" out of Exports when it's only
+	// implied by assigning module.exports. HasDefault is set either way.
+	ExcludeSynthesizedDefault bool
+	// Strict returns an error instead of silently dropping exports that can't
+	// be analyzed, like unsafe getters and dynamic `exports[key] = ...`
+	// assignments. Copy loops like `for (var p in m) exports[p] = m[p]` are
+	// allowed when they're reported as Reexports, because m is a require
+	// result or the parameter of a copy helper like TypeScript's __export.
+	Strict bool
+	// DetectUMD treats the first parameter of a UMD factory as exports, for
+	// minified wrappers like `})(this, function (e) { e.foo = 1; })`. The
+	// wrapper is detected by its `typeof exports === 'object'` check.
+	DetectUMD bool
+	// GlobalName treats a browser global like globalThis.MyLib, self.MyLib or
+	// window.MyLib as module.exports, for IIFE bundles that attach their
+	// exports to a global
+	GlobalName string
+	// TokenizerFallback finds exports by scanning tokens when the code can't
+	// be parsed, instead of returning an error. It only recognizes simple
+	// assignments like `exports.foo =` and `module.exports.foo =`.
+	TokenizerFallback bool
+	// KeepShebang parses a leading #! line as code instead of stripping it,
+	// for pipelines that already removed the shebang
+	KeepShebang bool
+	// PreserveOrder returns exports in the order they're first found in the
+	// source, with a synthesized default last, instead of sorting them
+	PreserveOrder bool
+	// SafeDefinitionWins keeps an export that's redefined with an unsafe
+	// getter after a safe definition like `exports.x = 1`. Otherwise the
+	// export is dropped. Either way there's a diagnostic.
+	SafeDefinitionWins bool
+	// TreatThisAsExports treats `this` as exports, like `this.foo = 1` or
+	// `Object.defineProperty(this, "foo", ...)`, at the top level and inside
+	// wrappers called with it, like `(function () { ... }).call(this)`.
+	// CommonJS modules run with `this` bound to exports.
+	TreatThisAsExports bool
+	// InspectForEach exports the names of a forEach over an array of string
+	// literals whose callback assigns its parameter to exports, like
+	// `["a", "b"].forEach(function (k) { exports[k] = impl[k]; })`
+	InspectForEach bool
+	// JSOptions are passed through to the JavaScript parser
+	JSOptions js.Options
+}
+
+// DefaultParseOptions returns the options used by ParseExports, which are
+// the zero value
+func DefaultParseOptions() ParseOptions {
+	return ParseOptions{}
+}
+
+// Result of parsing the exports of a CommonJS module
+type Result struct {
+	// Exports are the export names, including "default" when module.exports
+	// is assigned. They're sorted unless PreserveOrder is set. This is what
+	// ParseExports returns.
+	Exports []string
+	// HasDefault is true when module.exports is assigned as a whole
+	HasDefault bool
+	// HasESModule is true when the module sets the __esModule interop flag
+	HasESModule bool
+	// Diagnostics are notes about code that couldn't be fully analyzed
+	Diagnostics []Diagnostic
+	// Reexports are the modules whose exports this module re-exports, in
+	// order of first occurrence
+	Reexports []Reexport
+	// Requires are the specifiers of static `require("specifier")` calls,
+	// including re-exported ones, in order of first occurrence
+	Requires []string
+	// Details about each export, in the same order as Exports
+	Details []Export
+}
+
+// Export describes a single named export
+type Export struct {
+	// Name of the export
+	Name string
+	// ReexportFrom is the specifier of the module this export is a live
+	// binding to, like `get: function () { return require("./y").x; }`
+	ReexportFrom string
+	// ReexportName is the name of the export in the ReexportFrom module
+	ReexportName string
+	// Kind is "live" for bindings defined with both a getter and a setter,
+	// which may change after the module is loaded, or "" otherwise
+	Kind string
+	// Via is how the export was declared: "exports-assign",
+	// "module-exports-object", "define-property", "object-assign", "getter"
+	// or "reexport". It's "" for the synthesized default export.
+	Via string
+}
+
+// Diagnostic is a note about the analyzed code
+type Diagnostic struct {
+	// Offset in the source that the diagnostic refers to, or -1 if unknown
+	Offset int
+	// Message describing the diagnostic
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Offset < 0 {
+		return d.Message
+	}
+	return fmt.Sprintf("%d: %s", d.Offset, d.Message)
+}
+
+// Reexport is a module re-exported through module.exports = require(...),
+// a ...require(...) spread or a star re-export helper
+type Reexport struct {
+	// Specifier passed to require
+	Specifier string
+}
+
+// Parse the exports of a CommonJS module
+func Parse(path, code string, opts ParseOptions) (*Result, error) {
+	shebang := ""
+	if !opts.KeepShebang {
+		shebang, code = extractShebang(code)
+	}
+	input := parse.NewInputString(code)
+	ast, err := js.Parse(input, opts.JSOptions)
+	if err != nil {
+		perr := newParseError(path, shebang, code, err)
+		if !opts.TokenizerFallback {
+			return nil, perr
+		}
+		// Find what exports we can without a syntax tree
+		result := scanExports(code, opts)
+		result.Diagnostics = append(result.Diagnostics, Diagnostic{
+			Offset:  perr.Offset,
+			Message: fmt.Sprintf("exports were found by scanning tokens because parsing failed: %v", perr.Err),
+		})
+		return result, nil
+	}
+	// Offsets are relative to the code with the shebang
+	return parseAST(ast, input.Bytes(), len(shebang), opts)
+}
+
+// ReparseExports analyzes newCode after an edit, where the edited text spans
+// [editStart, editEnd) of newCode and prev is the result before the edit.
+// It returns the same result as Parse with DefaultParseOptions. For now it
+// always reparses, but callers that pass the edit can benefit from
+// incremental analysis later.
+func ReparseExports(prev *Result, path, newCode string, editStart, editEnd int) (*Result, error) {
+	if editStart < 0 || editStart > editEnd || editEnd > len(newCode) {
+		return nil, fmt.Errorf("cjs: invalid edit range %d-%d in %s", editStart, editEnd, path)
+	}
+	return Parse(path, newCode, DefaultParseOptions())
+}
+
+// parseAST parses the exports from the AST. The src of the AST is optional
+// and only used for offsets, which start at base.
+func parseAST(ast *js.AST, src []byte, base int, opts ParseOptions) (*Result, error) {
+	visitor := &exportVisitor{
+		opts:             opts,
+		src:              src,
+		base:             base,
+		exports:          make(map[string]bool),
+		hasDefaultExport: false,
+		unsafeGetters:    make(map[string]bool),
+		aliases:          make(map[*js.Var]bool),
+		moduleAliases:    make(map[*js.Var]bool),
+		shadowed:         make(map[*js.Var]bool),
+		objectVars:       make(map[*js.Var]*js.ObjectExpr),
+		localProps:       make(map[*js.Var][]string),
+		dynamicLocals:    make(map[*js.Var]bool),
+		requireVars:      make(map[string]string),
+		copyHelpers:      make(map[string]int),
+		copyKeys:         make(map[*js.Var]bool),
+		constants:        findConstants(ast),
+		details:          make(map[string]Export),
+		wrappers:         make(map[*js.FuncDecl]bool),
+		forEachKeys:      make(map[*js.Var]bool),
+		assignSites:      make(map[string][]int),
+	}
+
+	js.Walk(visitor, ast)
+
+	// Check for errors during traversal
+	if visitor.err != nil {
+		return nil, visitor.err
+	}
+
+	// Warn about named exports discarded by a module.exports reassignment
+	visitor.checkShadowedExports(ast.BlockStmt.List)
+
+	// Warn about exports assigned more than once
+	visitor.checkReassignedExports()
+
+	// Add properties attached to an identifier assigned to module.exports
+	visitor.extractAttachedProps(ast.BlockStmt.List)
+
+	// Add the exports of modules re-exported through module.exports = require(...)
+	visitor.extractModuleReexports(ast.BlockStmt.List)
+	if visitor.err != nil {
+		return nil, visitor.err
+	}
+
+	// Remove any exports that were marked as unsafe getters
+	for name := range visitor.unsafeGetters {
+		delete(visitor.exports, name)
+	}
+
+	// Convert map to slice
+	exports := make([]string, 0, len(visitor.exports)+1)
+	for _, name := range visitor.order {
+		if !visitor.exports[name] || (name == "__esModule" && opts.ExcludeESModuleFlag) {
+			continue
+		}
+		exports = append(exports, name)
+	}
+
+	// Add default export if present
+	if visitor.hasDefaultExport && !opts.ExcludeSynthesizedDefault && !visitor.exports["default"] {
+		exports = append(exports, "default")
+	}
+
+	if !opts.PreserveOrder {
+		sort.Strings(exports)
+	}
+
+	// Describe each export
+	details := make([]Export, len(exports))
+	for i, name := range exports {
+		detail, ok := visitor.details[name]
+		if !ok {
+			detail = Export{Name: name}
+		}
+		details[i] = detail
+	}
+
+	return &Result{
+		Exports:     exports,
+		HasDefault:  visitor.hasDefaultExport,
+		HasESModule: visitor.exports["__esModule"],
+		Diagnostics: visitor.diagnostics,
+		Reexports:   visitor.reexports,
+		Requires:    visitor.requires,
+		Details:     details,
+	}, nil
+}
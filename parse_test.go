@@ -0,0 +1,413 @@
+package cjs_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+func TestParse(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		Object.defineProperty(exports, "__esModule", { value: true });
+		exports.a = 1;
+		__exportStar(require("./b"), exports);
+		module.exports = { ...require("./c"), d };
+		tslib.__exportStar(require("./b"), exports);
+	`, cjs.ParseOptions{})
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"__esModule", "a", "d", "default"})
+	is.True(result.HasDefault)
+	is.True(result.HasESModule)
+	is.Equal(result.Reexports, []cjs.Reexport{
+		{Specifier: "./b"},
+		{Specifier: "./c"},
+	})
+	is.Equal(len(result.Diagnostics), 1)
+	is.Equal(result.Diagnostics[0].Message, `export "a" is shadowed by the module.exports reassignment`)
+}
+
+func TestParseNoDefault(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		exports.a = 1;
+		module.exports = require("./b");
+	`, cjs.ParseOptions{})
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "default"})
+	is.True(result.HasDefault)
+	is.True(!result.HasESModule)
+	is.Equal(result.Reexports, []cjs.Reexport{{Specifier: "./b"}})
+	result, err = cjs.Parse("test.js", `exports.a = 1;`, cjs.ParseOptions{})
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a"})
+	is.True(!result.HasDefault)
+	is.Equal(len(result.Reexports), 0)
+}
+
+func TestParseExportsDefault(t *testing.T) {
+	is := is.New(t)
+	exports, err := cjs.ParseExports("test.js", `
+		exports.default = 1;
+		module.exports = x;
+	`)
+	is.NoErr(err)
+	is.Equal(exports, []string{"default"})
+}
+
+func TestParseGetterReexport(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		var z_1 = require("./z");
+		Object.defineProperty(exports, "x", { enumerable: true, get: function () { return require("./y").x; } });
+		Object.defineProperty(exports, "w", { enumerable: true, get() { return z_1.v; } });
+		Object.defineProperty(exports, "u", { enumerable: true, get: function () { return other.u; } });
+	`, cjs.ParseOptions{})
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"u", "w", "x"})
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "u", Via: "getter"},
+		{Name: "w", ReexportFrom: "./z", ReexportName: "v", Via: "getter"},
+		{Name: "x", ReexportFrom: "./y", ReexportName: "x", Via: "getter"},
+	})
+}
+
+func TestParseExcludeESModuleFlag(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		Object.defineProperty(exports, "__esModule", { value: true });
+		exports.a = 1;
+	`, cjs.ParseOptions{ExcludeESModuleFlag: true})
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a"})
+	is.True(result.HasESModule)
+}
+
+func TestParseShadowedExports(t *testing.T) {
+	is := is.New(t)
+	code := `#!/usr/bin/env node
+exports.a = 1;
+exports["b"] = 2;
+module.exports = somethingElse;
+module.exports.c = 3;
+`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "default"})
+	offset := strings.Index(code, "exports = somethingElse")
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: offset, Message: `export "a" is shadowed by the module.exports reassignment`},
+		{Offset: offset, Message: `export "b" is shadowed by the module.exports reassignment`},
+	})
+
+	result, err = cjs.Parse("test.js", `
+		exports.a = 1;
+		module.exports = Object.assign(exports, { b: 2 });
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 0)
+}
+
+func TestParseNoSynthesizedDefault(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultParseOptions()
+	opts.ExcludeSynthesizedDefault = true
+	result, err := cjs.Parse("test.js", `module.exports = 'asdf';`, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	is.True(result.HasDefault)
+	result, err = cjs.Parse("test.js", `
+		exports.default = 1;
+		module.exports.a = 2;
+	`, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "default"})
+	is.True(!result.HasDefault)
+}
+
+func TestParseStrictDynamicKey(t *testing.T) {
+	is := is.New(t)
+	code := `
+		exports[name] = 1;
+		for (var p in m) exports[p] = m[p];
+	`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.Strict = true
+	result, err = cjs.Parse("test.js", code, opts)
+	is.True(err != nil)
+	is.Equal(result, nil)
+	is.Equal(err.Error(), "cjs: dynamic export key in exports[name]")
+	// Copies of a re-export are reported as Reexports
+	_, err = cjs.Parse("test.js", `
+		var m = require("./m");
+		for (var p in m) exports[p] = m[p];
+		function __export(n) { for (var k in n) if (!exports.hasOwnProperty(k)) exports[k] = n[k]; }
+		__export(require("./n"));
+	`, opts)
+	is.NoErr(err)
+	// Copies of anything else lose their names
+	_, err = cjs.Parse("test.js", `
+		var config = { a: 1 };
+		for (var p in config) exports[p] = config[p];
+	`, opts)
+	is.True(err != nil)
+	is.Equal(err.Error(), "cjs: dynamic export key in exports[p]")
+}
+
+func TestParseStrictUnsafeGetter(t *testing.T) {
+	is := is.New(t)
+	code := "#!/usr/bin/env node\n" + `Object.defineProperty(exports, "a", { get: function () { return compute(); } });`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.Strict = true
+	_, err = cjs.Parse("test.js", code, opts)
+	is.True(err != nil)
+	is.Equal(err.Error(), `cjs: unsafe getter for export "a" at offset 51`)
+}
+
+func TestParseLiveBinding(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.Parse("test.js", `
+		Object.defineProperty(exports, "a", { enumerable: true, get: function () { return state.a; }, set: function (v) { state.a = v; } });
+		Object.defineProperty(exports, "b", { enumerable: true, get() { return state.b; }, set(v) { state.b = v; } });
+		Object.defineProperty(exports, "c", { enumerable: true, get: function () { return state.c; } });
+	`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "a", Kind: "live", Via: "getter"},
+		{Name: "b", Kind: "live", Via: "getter"},
+		{Name: "c", Via: "getter"},
+	})
+}
+
+func TestParseTokenizerFallback(t *testing.T) {
+	is := is.New(t)
+	code := `
+		exports.foo = 1;
+		var re = /=/g;
+		exports["bar"] = value |> double;
+		module.exports.baz = function () {};
+		other.exports.qux = 2;
+	`
+	_, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.True(err != nil)
+	opts := cjs.DefaultParseOptions()
+	opts.TokenizerFallback = true
+	result, err := cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"bar", "baz", "foo"})
+	is.Equal(len(result.Diagnostics), 1)
+	is.True(strings.HasPrefix(result.Diagnostics[0].Message, "exports were found by scanning tokens"))
+}
+
+func TestParseVia(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultParseOptions()
+	opts.Resolve = func(specifier string) ([]string, error) {
+		return []string{"e"}, nil
+	}
+	result, err := cjs.Parse("test.js", `
+		exports.a = 1;
+		module.exports["b"] = 2;
+		Object.defineProperty(exports, "c", { value: 3 });
+		Object.defineProperty(exports, "d", { enumerable: true, get: function () { return dep.d; } });
+		__exportStar(require("./e"), exports);
+	`, opts)
+	is.NoErr(err)
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "a", Via: "exports-assign"},
+		{Name: "b", Via: "exports-assign"},
+		{Name: "c", Via: "define-property"},
+		{Name: "d", Via: "getter"},
+		{Name: "e", Via: "reexport"},
+	})
+	result, err = cjs.Parse("test.js", `module.exports = { f: 1, g };`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "default"},
+		{Name: "f", Via: "module-exports-object"},
+		{Name: "g", Via: "module-exports-object"},
+	})
+	result, err = cjs.Parse("test.js", `module.exports = Object.assign(module.exports, { h: 1 });`, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "default"},
+		{Name: "h", Via: "object-assign"},
+	})
+}
+
+func TestParseKeepShebang(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultParseOptions()
+	opts.KeepShebang = true
+	// The parser itself accepts a hashbang at the very start
+	result, err := cjs.Parse("test.js", "#!/usr/bin/env node\nexports.a = 1;", opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a"})
+	// But not after other content
+	code := "\n#!/usr/bin/env node\nexports.a = 1;"
+	result, err = cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a"})
+	_, err = cjs.Parse("test.js", code, opts)
+	var perr *cjs.ParseError
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Line, 2)
+}
+
+func TestParsePreserveOrder(t *testing.T) {
+	is := is.New(t)
+	code := `
+		exports.zebra = 1;
+		Object.defineProperty(exports, "__esModule", { value: true });
+		exports.apple = 2;
+		module.exports = { mango: 3, zebra: 4 };
+	`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"__esModule", "apple", "default", "mango", "zebra"})
+	opts := cjs.DefaultParseOptions()
+	opts.PreserveOrder = true
+	result, err = cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"zebra", "__esModule", "apple", "mango", "default"})
+	is.Equal(result.Details[0], cjs.Export{Name: "zebra", Via: "exports-assign"})
+}
+
+func TestParseSafeDefinitionWins(t *testing.T) {
+	is := is.New(t)
+	code := `
+		exports.x = 1;
+		Object.defineProperty(exports, "x", { get() { return dynamic(); } });
+	`
+	offset := strings.Index(code, `"x"`)
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: offset, Message: `export "x" is dropped because it's redefined with an unsafe getter`},
+	})
+	opts := cjs.DefaultParseOptions()
+	opts.SafeDefinitionWins = true
+	result, err = cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"x"})
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: offset, Message: `export "x" is kept even though it's redefined with an unsafe getter`},
+	})
+}
+
+func TestParseTreatThisAsExports(t *testing.T) {
+	is := is.New(t)
+	code := `
+		this.a = 1;
+		Object.defineProperty(this, "b", { value: 2 });
+		(function () {
+			this["c"] = 3;
+			Object.defineProperty(this, "d", { enumerable: true, get: function () { return this.inner; } });
+		}).call(this);
+		(() => { this.e = 5; })();
+		(function () { this.leak = 6; })();
+		(function () { this.global = 7; }).call(globalThis);
+		function Widget() { this.notExported = 4; }
+		class Thing { constructor() { this.alsoNot = 5; } }
+	`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.TreatThisAsExports = true
+	result, err = cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "d", "e"})
+}
+
+func TestParseInspectForEach(t *testing.T) {
+	is := is.New(t)
+	code := `
+		["a", "b", "c"].forEach(function (k) { exports[k] = impl[k]; });
+		["d"].forEach((k) => { module.exports[k] = create(k); });
+		["e"].forEach(function (k) { other[k] = impl[k]; });
+		names.forEach(function (k) { exports[k] = impl[k]; });
+		["f", g].forEach(function (k) { exports[k] = impl[k]; });
+	`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{})
+	opts := cjs.DefaultParseOptions()
+	opts.InspectForEach = true
+	result, err = cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "d"})
+	// The known keys aren't dynamic in strict mode
+	opts.Strict = true
+	_, err = cjs.Parse("test.js", `["d"].forEach((k) => { module.exports[k] = create(k); });`, opts)
+	is.NoErr(err)
+}
+
+func TestParseJSOptions(t *testing.T) {
+	is := is.New(t)
+	code := "#!/usr/bin/env node\nexports.a = 1;"
+	opts := cjs.DefaultParseOptions()
+	opts.KeepShebang = true
+	result, err := cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a"})
+	// Inline scripts don't allow a hashbang
+	opts.JSOptions = js.Options{Inline: true}
+	_, err = cjs.Parse("test.js", code, opts)
+	is.True(err != nil)
+}
+
+func TestReparseExports(t *testing.T) {
+	is := is.New(t)
+	code := "exports.a = 1;\nexports.b = 2;\n"
+	prev, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	// Rename b to c
+	edited := strings.Replace(code, "exports.b", "exports.c", 1)
+	start := strings.Index(edited, "c =")
+	result, err := cjs.ReparseExports(prev, "test.js", edited, start, start+1)
+	is.NoErr(err)
+	expected, err := cjs.ParseExports("test.js", edited)
+	is.NoErr(err)
+	is.Equal(result.Exports, expected)
+	is.Equal(result.Exports, []string{"a", "c"})
+	// Insert module.exports at the end
+	edited += "module.exports.d = 3;\n"
+	result, err = cjs.ReparseExports(result, "test.js", edited, len(edited)-22, len(edited))
+	is.NoErr(err)
+	expected, err = cjs.ParseExports("test.js", edited)
+	is.NoErr(err)
+	is.Equal(result.Exports, expected)
+	_, err = cjs.ReparseExports(result, "test.js", edited, 5, 2)
+	is.Equal(err.Error(), "cjs: invalid edit range 5-2 in test.js")
+}
+
+func TestParseReassignedExports(t *testing.T) {
+	is := is.New(t)
+	code := `exports.x = 1;
+exports.x = 2;
+if (cond) exports["x"] = 3;
+exports.y = exports.y || {};
+`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"x", "y"})
+	first := strings.Index(code, "x = 1")
+	second := strings.Index(code, "x = 2")
+	third := strings.Index(code, `"x"`)
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: first, Message: fmt.Sprintf(`export "x" is assigned 3 times, at offsets %d, %d, %d`, first, second, third)},
+	})
+}
@@ -0,0 +1,251 @@
+package cjs
+
+import (
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// handleStarReexport detects properties of a required module being copied
+// onto exports in a loop, which is how TypeScript compiles `export * from`:
+//
+//	function __export(m) {
+//		for (var p in m) if (!exports.hasOwnProperty(p)) exports[p] = m[p];
+//	}
+//	__export(require("dep"));
+//
+// The names are dynamic, so they're only known through the resolver.
+// Calls to the well-known __export and __exportStar helpers are recognized
+// even when the helper is imported, like tslib.__exportStar(require("dep")).
+func (v *exportVisitor) handleStarReexport(n js.INode) {
+	switch n := n.(type) {
+	case *js.FuncDecl:
+		// function __export(m) { for (var p in m) exports[p] = m[p]; }
+		if n.Name != nil {
+			v.trackCopyHelper(string(n.Name.Data), n)
+		}
+	case *js.VarDecl:
+		for _, item := range n.List {
+			ident, ok := item.Binding.(*js.Var)
+			if !ok || item.Default == nil {
+				continue
+			}
+			if specifier := v.requireSpecifier(item.Default); specifier != "" {
+				// var m = require("dep")
+				v.requireVars[string(ident.Data)] = specifier
+			} else if fn := v.helperFunc(item.Default); fn != nil {
+				// var __exportStar = (this && this.__exportStar) || function (m, exports) { ... }
+				v.trackCopyHelper(string(ident.Data), fn)
+			}
+		}
+	case *js.ForInStmt:
+		// var m = require("dep"); for (var p in m) exports[p] = m[p];
+		if source := v.copyLoopSource(n); source != "" {
+			if specifier, ok := v.requireVars[source]; ok {
+				v.reexport(specifier)
+				v.copyKeys[binding(loopKey(n))] = true
+			}
+		}
+	case *js.CallExpr:
+		// __export(require("dep"))
+		index, ok := v.copyHelperIndex(n.X)
+		if !ok || index >= len(n.Args.List) {
+			return
+		}
+		if specifier := v.requireSpecifier(n.Args.List[index].Value); specifier != "" {
+			v.reexport(specifier)
+		}
+	}
+}
+
+// copyHelperIndex returns the index of the argument copied onto exports when
+// callee is a copy helper
+func (v *exportVisitor) copyHelperIndex(callee js.IExpr) (int, bool) {
+	var name string
+	switch callee := callee.(type) {
+	case *js.Var:
+		name = string(callee.Data)
+		if index, ok := v.copyHelpers[name]; ok {
+			return index, true
+		}
+	case *js.DotExpr:
+		name = v.extractDotName(callee.Y)
+	}
+	switch name {
+	case "__export", "__exportStar":
+		return 0, true
+	}
+	return 0, false
+}
+
+// helperFunc unwraps the function from a helper definition like
+// `(this && this.__exportStar) || function (m, exports) { ... }`
+func (v *exportVisitor) helperFunc(expr js.IExpr) *js.FuncDecl {
+	switch expr := expr.(type) {
+	case *js.FuncDecl:
+		return expr
+	case *js.BinaryExpr:
+		if expr.Op == js.OrToken {
+			return v.helperFunc(expr.Y)
+		}
+	}
+	return nil
+}
+
+// trackCopyHelper records fn as a copy helper if its body copies one of its
+// parameters onto exports
+func (v *exportVisitor) trackCopyHelper(name string, fn *js.FuncDecl) {
+	for _, stmt := range fn.Body.List {
+		loop, ok := stmt.(*js.ForInStmt)
+		if !ok {
+			continue
+		}
+		source := v.copyLoopSource(loop)
+		for i, param := range fn.Params.List {
+			if ident, ok := param.Binding.(*js.Var); ok && string(ident.Data) == source {
+				v.copyHelpers[name] = i
+				v.copyKeys[binding(loopKey(loop))] = true
+				return
+			}
+		}
+	}
+}
+
+// copyLoopSource returns the name of the object being copied onto exports by
+// a `for (var p in m) exports[p] = m[p]` loop, or "" if it's not a copy loop
+func (v *exportVisitor) copyLoopSource(loop *js.ForInStmt) string {
+	source, ok := loop.Value.(*js.Var)
+	if !ok {
+		return ""
+	}
+	key := loopKey(loop)
+	if key == nil {
+		return ""
+	}
+	if !v.hasCopyAssignment(loop.Body, string(key.Data), string(source.Data)) {
+		return ""
+	}
+	return string(source.Data)
+}
+
+// loopKey returns the key variable of a for-in loop, like p in
+// `for (var p in m)`, or nil if it's not a plain variable
+func loopKey(loop *js.ForInStmt) *js.Var {
+	switch init := loop.Init.(type) {
+	case *js.VarDecl:
+		if len(init.List) == 1 {
+			key, _ := init.List[0].Binding.(*js.Var)
+			return key
+		}
+	case *js.Var:
+		return init
+	}
+	return nil
+}
+
+// hasCopyAssignment looks for `exports[key] = source[key]` in the statement,
+// descending into blocks and if statements used as guards
+func (v *exportVisitor) hasCopyAssignment(stmt js.IStmt, key, source string) bool {
+	switch stmt := stmt.(type) {
+	case *js.BlockStmt:
+		for _, item := range stmt.List {
+			if v.hasCopyAssignment(item, key, source) {
+				return true
+			}
+		}
+	case *js.IfStmt:
+		return v.hasCopyAssignment(stmt.Body, key, source)
+	case *js.ExprStmt:
+		bin, ok := stmt.Value.(*js.BinaryExpr)
+		if !ok || bin.Op != js.EqToken {
+			return false
+		}
+		left, ok := bin.X.(*js.IndexExpr)
+		if !ok || !v.isExportsObject(left.X) || !isIdentNamed(left.Y, key) {
+			return false
+		}
+		right, ok := bin.Y.(*js.IndexExpr)
+		return ok && isIdentNamed(right.X, source) && isIdentNamed(right.Y, key)
+	}
+	return false
+}
+
+// requireSpecifier returns the specifier of a `require("specifier")` call
+func (v *exportVisitor) requireSpecifier(expr js.IExpr) string {
+	call, ok := expr.(*js.CallExpr)
+	if !ok || len(call.Args.List) != 1 || !isIdentNamed(call.X, "require") {
+		return ""
+	}
+	return v.extractStringLiteral(unwrapGroup(call.Args.List[0].Value))
+}
+
+// addReexport records that the required module is re-exported
+func (v *exportVisitor) addReexport(specifier string) {
+	for _, reexport := range v.reexports {
+		if reexport.Specifier == specifier {
+			return
+		}
+	}
+	v.reexports = append(v.reexports, Reexport{Specifier: specifier})
+}
+
+// addRequire records a static require of the specifier
+func (v *exportVisitor) addRequire(specifier string) {
+	for _, required := range v.requires {
+		if required == specifier {
+			return
+		}
+	}
+	v.requires = append(v.requires, specifier)
+}
+
+// reexport records a star re-export and merges the named exports of the
+// required module when there's a resolver
+func (v *exportVisitor) reexport(specifier string) {
+	v.addReexport(specifier)
+	v.resolveReexport(specifier)
+}
+
+// extractModuleReexports merges the named exports of modules re-exported by
+// a top-level `module.exports = require("dep")`. Conditional re-exports like
+// `if (maybe) module.exports = require("dep")` aren't merged.
+func (v *exportVisitor) extractModuleReexports(stmts []js.IStmt) {
+	for _, stmt := range stmts {
+		expr, ok := stmt.(*js.ExprStmt)
+		if !ok {
+			continue
+		}
+		bin, ok := expr.Value.(*js.BinaryExpr)
+		if !ok || bin.Op != js.EqToken || !v.isModuleExports(bin.X) {
+			continue
+		}
+		if specifier := v.requireSpecifier(bin.Y); specifier != "" {
+			v.resolveReexport(specifier)
+		}
+	}
+}
+
+// resolveReexport merges the named exports of the required module when
+// there's a resolver
+func (v *exportVisitor) resolveReexport(specifier string) {
+	if v.opts.Resolve == nil {
+		return
+	}
+	names, err := v.opts.Resolve(specifier)
+	if err != nil {
+		if v.err == nil {
+			v.err = err
+		}
+		return
+	}
+	for _, name := range names {
+		// Re-exports don't include the default export
+		if name != "default" && name != "" {
+			v.addExport(name, "reexport")
+		}
+	}
+}
+
+// isIdentNamed reports whether expr is an identifier with the given name
+func isIdentNamed(expr js.IExpr, name string) bool {
+	ident, ok := expr.(*js.Var)
+	return ok && string(ident.Data) == name
+}
@@ -0,0 +1,104 @@
+package cjs_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestTypescriptReexportsResolver(t *testing.T) {
+	is := is.New(t)
+	modules := map[string][]string{
+		"external1": {"a", "b", "default"},
+		"external2": {"c"},
+		"external3": {"d"},
+	}
+	exports, err := cjs.ParseExportsWith("test.js", `
+		"use strict";
+		function __export(m) {
+			for (var p in m) if (!exports.hasOwnProperty(p)) exports[p] = m[p];
+		}
+		var __exportStar = (this && this.__exportStar) || function(m, exports) {
+			for (var p in m) if (p !== "default" && !exports.hasOwnProperty(p)) exports[p] = m[p];
+		};
+		Object.defineProperty(exports, "__esModule", { value: true });
+		__export(require("external1"));
+		__exportStar(require("external2"), exports);
+		var m = require("external3");
+		for (var k in m) exports[k] = m[k];
+		var n = require("unused");
+		for (var k in n) other[k] = n[k];
+	`, cjs.ParseOptions{
+		Resolve: func(specifier string) ([]string, error) {
+			names, ok := modules[specifier]
+			if !ok {
+				return nil, fmt.Errorf("unexpected resolve of %q", specifier)
+			}
+			return names, nil
+		},
+	})
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"__esModule",
+		"a",
+		"b",
+		"c",
+		"d",
+	})
+}
+
+func TestModuleAssignResolver(t *testing.T) {
+	is := is.New(t)
+	resolve := func(specifier string) ([]string, error) {
+		switch specifier {
+		case "./asdf":
+			return []string{"a", "b", "default"}, nil
+		case "./another":
+			return []string{"c"}, nil
+		}
+		return nil, fmt.Errorf("unexpected resolve of %q", specifier)
+	}
+	exports, err := cjs.ParseExportsWith("test.js", `
+		module.exports.asdf = 'asdf';
+		exports = 'asdf';
+		module.exports = require('./asdf');
+		if (maybe)
+			module.exports = require("./another");
+	`, cjs.ParseOptions{Resolve: resolve})
+	is.NoErr(err)
+	exportsEqual(t, exports, []string{
+		"a",
+		"asdf",
+		"b",
+		"default",
+	})
+}
+
+func TestObjectAssignRequireResolver(t *testing.T) {
+	is := is.New(t)
+	code := `
+		Object.assign(module.exports, require("/node_modules/dep"), { c: 3 });
+	`
+	result, err := cjs.Parse("test.js", code, cjs.DefaultParseOptions())
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"c", "default"})
+	is.Equal(result.Reexports, []cjs.Reexport{{Specifier: "/node_modules/dep"}})
+	opts := cjs.DefaultParseOptions()
+	opts.Resolve = func(specifier string) ([]string, error) {
+		if specifier != "/node_modules/dep" {
+			return nil, fmt.Errorf("unexpected resolve of %q", specifier)
+		}
+		return []string{"a", "b", "default"}, nil
+	}
+	result, err = cjs.Parse("test.js", code, opts)
+	is.NoErr(err)
+	is.Equal(result.Exports, []string{"a", "b", "c", "default"})
+	is.Equal(result.Details, []cjs.Export{
+		{Name: "a", Via: "reexport"},
+		{Name: "b", Via: "reexport"},
+		{Name: "c", Via: "object-assign"},
+		{Name: "default"},
+	})
+}
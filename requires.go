@@ -1,115 +1,615 @@
 package cjs
 
 import (
+	"bytes"
 	"fmt"
+	pathpkg "path"
 	"regexp"
+	"sort"
 	"strings"
+	"unsafe"
 
 	"github.com/tdewolff/parse/v2"
 	"github.com/tdewolff/parse/v2/js"
 )
 
+// RewriteOptions configures RewriteRequiresWith
+type RewriteOptions struct {
+	// Prefix that require paths must start with to be hoisted into imports
+	Prefix string
+	// PlainPrefix matches the prefix as a plain string prefix, so
+	// "/node_modules" also matches "/node_modules_backup/react". Otherwise the
+	// prefix must end at a path boundary.
+	PlainPrefix bool
+	// StripQuery ignores ?query and #hash suffixes when deriving imports, so
+	// "/node_modules/react" and "/node_modules/react?x" share one import
+	StripQuery bool
+	// ErrorOnESM returns an error when the source already contains ESM import
+	// or export statements, instead of only transforming the requires
+	ErrorOnESM bool
+	// SortImports sorts the generated imports and __cjs_imports__ entries by
+	// path instead of keeping the order of first occurrence
+	SortImports bool
+	// NormalizeSeparators treats backslashes in require paths as forward
+	// slashes, both for matching and in the emitted imports
+	NormalizeSeparators bool
+	// AllowExtraArgs matches require-like calls with more than one argument,
+	// like `__webpack_require__("/node_modules/x", options)`, as long as the
+	// first argument is a string literal. The extra arguments are kept.
+	AllowExtraArgs bool
+	// AnnotateReplacements adds a comment after each rewritten call with the
+	// original function name, like `__cjs_require__("x") /* was __require */`
+	AnnotateReplacements bool
+	// Inline replaces each require call with its import binding, like
+	// `__cjs_import_react__`, and skips the __cjs_require__ helper. It falls
+	// back to the helper when a call can't be replaced as a whole or two
+	// imports would share a binding name.
+	Inline bool
+	// OnMissing controls what __cjs_require__ does when a path isn't imported
+	OnMissing MissingBehavior
+	// StripPrefixInImport removes the prefix from matched paths, so
+	// __require("/node_modules/react") imports from "react" and becomes
+	// __cjs_require__("react")
+	StripPrefixInImport bool
+	// CanonicalizePaths removes trailing slashes from require paths, so
+	// "/node_modules/react/" and "/node_modules/react" share one import
+	CanonicalizePaths bool
+	// CanonicalizeIndex removes /index and /index.js suffixes from require
+	// paths, so "/node_modules/react/index.js" imports "/node_modules/react"
+	CanonicalizeIndex bool
+	// InteropDefault unwraps the default export of each import when it has
+	// one, like Node's CommonJS interop, so __cjs_imports__ maps to
+	// `__cjs_import_x__.default ?? __cjs_import_x__`
+	InteropDefault bool
+	// RemapPrefix swaps the prefix of matched paths, like "/node_modules/" to
+	// "/cdn/npm/", in the imports, the __cjs_imports__ keys and the rewritten
+	// calls. The longest matching prefix wins.
+	RemapPrefix map[string]string
+	// KeepShebang parses a leading #! line as code instead of stripping it,
+	// for pipelines that already removed the shebang
+	KeepShebang bool
+	// GroupImports groups the sorted imports by their scope or package, like
+	// all the @babel/* imports, with a blank line between groups. It only
+	// applies with SortImports.
+	GroupImports bool
+	// WrapModule makes the output a runnable ES module by declaring module
+	// and exports before the body and default exporting module.exports after
+	WrapModule bool
+	// Resolve maps the path of each require-like call, like "./react" to
+	// "/node_modules/react", before it's matched against the prefix. When ok,
+	// the resolved path is imported and replaces the path in the call.
+	Resolve func(rawPath string) (resolvedPath string, ok bool)
+	// RequireStatic returns an error listing the calls to require, or to a
+	// function used like require elsewhere in the file, that don't have a
+	// constant path, along with their offsets
+	RequireStatic bool
+	// JSOptions are passed through to the JavaScript parser
+	JSOptions js.Options
+	// Exclude lists matched paths to leave as runtime requires, like native
+	// addons. They're neither imported nor rewritten.
+	Exclude []string
+	// KeepTryRequires leaves requires inside try blocks as runtime requires,
+	// so optional dependencies that fail to load can still be caught
+	KeepTryRequires bool
+	// FreezeImports wraps the __cjs_imports__ mapping in Object.freeze so it
+	// can't be mutated at runtime
+	FreezeImports bool
+	// PreferNamedImports turns top-level destructured requires like
+	// `const { default: X, other } = __require("/node_modules/x")` into
+	// imports like `import X, { other } from "/node_modules/x"`. Only const
+	// declarations of plain bindings qualify, since imports can't be
+	// reassigned or have defaults.
+	PreferNamedImports bool
+}
+
+// moduleShim declares the CommonJS locals for WrapModule. They're let since
+// modules may reassign them, like `exports = module.exports = fn`.
+const moduleShim = "let module = { exports: {} };\nlet exports = module.exports;\n"
+
+// MissingBehavior is what __cjs_require__ does for paths that weren't imported
+type MissingBehavior int
+
+const (
+	// Throw an error for missing modules
+	Throw MissingBehavior = iota
+	// ReturnUndefined returns undefined for missing modules
+	ReturnUndefined
+)
+
+// missingStmt returns the statement run for missing modules
+func (m MissingBehavior) missingStmt() string {
+	if m == ReturnUndefined {
+		return "return undefined"
+	}
+	return `throw new Error("Module not found: " + path)`
+}
+
+// importValue returns the expression for the value of an import binding,
+// grouped when it replaces a call in place
+func (opts RewriteOptions) importValue(importName string, grouped bool) string {
+	if !opts.InteropDefault {
+		return importName
+	}
+	value := importName + ".default ?? " + importName
+	if grouped {
+		return "(" + value + ")"
+	}
+	return value
+}
+
+// DefaultRewriteOptions returns the recommended options for the given prefix,
+// which are the zero value with the prefix set
+func DefaultRewriteOptions(prefix string) RewriteOptions {
+	return RewriteOptions{Prefix: prefix}
+}
+
+// RewriteRequires hoists require calls whose path starts with prefix into ES
+// imports. The prefix is matched as a plain string prefix.
 func RewriteRequires(path, prefix, source string) (string, error) {
+	return RewriteRequiresWith(path, source, RewriteOptions{Prefix: prefix, PlainPrefix: true})
+}
+
+// RewriteRequiresWith is like RewriteRequires but accepts options
+func RewriteRequiresWith(path, source string, opts RewriteOptions) (string, error) {
+	result, err := RewriteRequiresResult(path, source, opts)
+	if err != nil {
+		return "", err
+	}
+	return result.Code, nil
+}
+
+// RewriteResult is the detailed result of rewriting requires
+type RewriteResult struct {
+	// Code is the rewritten source
+	Code string
+	// RequireFuncs are the distinct require-like function names that were
+	// rewritten, like __require or require2
+	RequireFuncs []string
+	// Paths are the matched require paths in order of first occurrence
+	Paths []string
+	// Diagnostics are warnings about requires that may not behave the same
+	// once hoisted into imports
+	Diagnostics []Diagnostic
+	// Edits turn the source into Code, sorted by their offset into the
+	// source. The first edit inserts the imports and require infrastructure after any
+	// shebang and directives.
+	Edits []Edit
+}
+
+// ListRequires returns the require paths starting with prefix in the order
+// they first appear, as RewriteRequires would import them
+func ListRequires(path, prefix, source string) ([]string, error) {
+	result, err := RewriteRequiresResult(path, source, RewriteOptions{Prefix: prefix, PlainPrefix: true})
+	if err != nil {
+		return nil, err
+	}
+	if result.Paths == nil {
+		return []string{}, nil
+	}
+	return result.Paths, nil
+}
+
+// RewriteRequiresEdits is like RewriteRequires but returns the edits to apply
+// to the source instead of the rewritten code. Edits are sorted by offset.
+func RewriteRequiresEdits(path, prefix, source string) ([]Edit, error) {
+	result, err := RewriteRequiresResult(path, source, RewriteOptions{Prefix: prefix, PlainPrefix: true})
+	if err != nil {
+		return nil, err
+	}
+	return result.Edits, nil
+}
+
+// RewriteRequiresResult is like RewriteRequiresWith but returns details about
+// what was rewritten
+func RewriteRequiresResult(path, source string, opts RewriteOptions) (*RewriteResult, error) {
+	// Skip parsing when no require path could possibly match the prefix
+	if !opts.WrapModule && !opts.RequireStatic && opts.Resolve == nil && !mayContainPrefix(source, opts) {
+		return &RewriteResult{Code: source}, nil
+	}
+
 	// Extract shebang if present
-	shebang, codeWithoutShebang := extractShebang(source)
+	shebang, codeWithoutShebang := "", source
+	if !opts.KeepShebang {
+		shebang, codeWithoutShebang = extractShebang(source)
+	}
 
 	// Parse the JavaScript (without shebang)
-	ast, err := js.Parse(parse.NewInputString(codeWithoutShebang), js.Options{})
+	input := parse.NewInputString(codeWithoutShebang)
+	ast, err := js.Parse(input, opts.JSOptions)
 	if err != nil {
-		return "", fmt.Errorf("cjs: failed to parse %s: %w", path, err)
+		return nil, newParseError(path, shebang, codeWithoutShebang, err)
+	}
+
+	// Refuse to transform files that mix in ESM syntax
+	if opts.ErrorOnESM && hasESMSyntax(ast) {
+		return nil, fmt.Errorf("cjs: %s already contains ESM syntax", path)
 	}
 
-	// Extract directive prologues (like "use strict") and get code without them
-	directives, codeWithoutDirectives := extractDirectivesString(ast, codeWithoutShebang)
+	// Extract directive prologues (like "use strict") and find where the code starts
+	directives, codeStart := extractDirectivesString(ast, codeWithoutShebang)
 
 	// Find all require-like calls and collect paths
 	visitor := &requireVisitor{
-		prefix:       prefix,
+		opts:         opts,
+		src:          input.Bytes(),
 		requires:     make(map[string]bool),
+		offsets:      make(map[string]int),
 		requireCalls: []requireCall{},
 		pathOrder:    []string{},
+		requireVars:  make(map[*js.Var]bool),
+		varRefs:      make(map[*js.Var]int),
+		varUses:      make(map[*js.Var]int),
+		tryBodies:    make(map[*js.BlockStmt]bool),
+		namedCalls:   make(map[*js.CallExpr]bool),
+	}
+	if opts.PreferNamedImports {
+		visitor.findNamedImports(ast.BlockStmt.List)
 	}
 	js.Walk(visitor, ast)
 
+	// Refuse requires that can't become static imports
+	if opts.RequireStatic {
+		if err := visitor.checkStatic(path, len(shebang)); err != nil {
+			return nil, err
+		}
+	}
+
 	// If no requires found, return original source
-	if len(visitor.requires) == 0 {
-		return source, nil
+	if len(visitor.requires) == 0 && len(visitor.namedImports) == 0 && !opts.WrapModule {
+		return &RewriteResult{Code: source}, nil
 	}
 
-	// Use the paths in the order they were discovered
-	paths := visitor.pathOrder
+	// Group the paths by the module they import, in the order they were discovered
+	var sources []string
+	sourcePaths := make(map[string][]string)
+	for _, reqPath := range visitor.pathOrder {
+		source := opts.importSource(reqPath)
+		if _, ok := sourcePaths[source]; !ok {
+			sources = append(sources, source)
+		}
+		sourcePaths[source] = append(sourcePaths[source], reqPath)
+	}
+	if opts.SortImports {
+		sort.Strings(sources)
+		if opts.GroupImports {
+			sort.SliceStable(sources, func(i, j int) bool {
+				return opts.importGroup(sources[i]) < opts.importGroup(sources[j])
+			})
+		}
+		for _, source := range sources {
+			sort.Strings(sourcePaths[source])
+		}
+	}
 
 	// Generate import statements and object mapping
 	var imports strings.Builder
 	var objMapping strings.Builder
+	importValues := make(map[string]string) // Inlined import value of each path
+	bindings := make(map[string]bool)
+	distinct := true
 
-	for i, reqPath := range paths {
-		importName := pathToImportName(reqPath)
+	for i, source := range sources {
+		importName := pathToImportName(source)
+		if bindings[importName] {
+			distinct = false
+		}
+		bindings[importName] = true
+		for _, reqPath := range sourcePaths[source] {
+			importValues[reqPath] = opts.importValue(importName, true)
+		}
 
-		// Import statement
-		fmt.Fprintf(&imports, "import %s from %q\n", importName, reqPath)
+		// Import statement, with a blank line between groups
+		if opts.SortImports && opts.GroupImports && i > 0 && opts.importGroup(source) != opts.importGroup(sources[i-1]) {
+			imports.WriteString("\n")
+		}
+		fmt.Fprintf(&imports, "import %s from %s\n", importName, quoteJS(source))
 
 		// Object mapping
-		if i > 0 {
-			objMapping.WriteString(",\n\t")
+		for j, reqPath := range sourcePaths[source] {
+			if i > 0 || j > 0 {
+				objMapping.WriteString(",\n\t")
+			}
+			fmt.Fprintf(&objMapping, "%s: %s", quoteJS(reqPath), opts.importValue(importName, false))
 		}
-		fmt.Fprintf(&objMapping, "%q: %s", reqPath, importName)
 	}
 
 	// Generate the require infrastructure
-	infrastructure := fmt.Sprintf(`%sconst __cjs_imports__ = {
-	%s,
-}
+	infrastructure := ""
+	if len(sources) > 0 {
+		mapping := "{\n\t" + objMapping.String() + ",\n}"
+		if opts.FreezeImports {
+			mapping = "Object.freeze(" + mapping + ")"
+		}
+		infrastructure = fmt.Sprintf(`%sconst __cjs_imports__ = %s
 function __cjs_require__(path) {
 	const req = __cjs_imports__[path]
 	if (!req) {
-		throw new Error("Module not found: " + path)
+		%s
 	}
 	return req
 }
-`, imports.String(), objMapping.String())
+`, imports.String(), mapping, opts.OnMissing.missingStmt())
+	}
+
+	// Replace the directives with the directives and infrastructure, then
+	// replace the require function calls with __cjs_require__
+	base := len(shebang)
+	callEdits := requireEdits(visitor.requireCalls, base, opts.AnnotateReplacements)
+	if opts.Inline && distinct && visitor.matches == len(visitor.requireCalls) {
+		// Replace the calls with the imports themselves when possible
+		if edits, ok := inlineEdits(visitor.src, visitor.requireCalls, importValues, base, opts.AnnotateReplacements); ok {
+			infrastructure = imports.String()
+			callEdits = edits
+		}
+	}
+	// Replace destructured requires with named imports in place
+	for _, named := range visitor.namedImports {
+		callEdits = append(callEdits, Edit{base + named.start, base + named.end, named.stmt})
+	}
+	// Provide module and exports to the body and export module.exports
+	if opts.WrapModule {
+		infrastructure += moduleShim
+		exportDefault := "export default module.exports;\n"
+		if !strings.HasSuffix(source, "\n") {
+			exportDefault = "\n" + exportDefault
+		}
+		callEdits = append(callEdits, Edit{len(source), len(source), exportDefault})
+	}
+	edits := append([]Edit{{base, base + codeStart, directives + infrastructure}}, callEdits...)
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].Start < edits[j].Start
+	})
+
+	// Collect the distinct require function names
+	funcs := make(map[string]bool)
+	for _, call := range visitor.requireCalls {
+		funcs[call.funcName] = true
+	}
+	requireFuncs := make([]string, 0, len(funcs))
+	for funcName := range funcs {
+		requireFuncs = append(requireFuncs, funcName)
+	}
+	sort.Strings(requireFuncs)
+
+	// Warn about modules that import themselves
+	diagnostics := visitor.bareReferences(len(shebang))
+	for _, reqPath := range visitor.pathOrder {
+		if isSelfRequire(path, reqPath) {
+			diagnostics = append(diagnostics, Diagnostic{
+				Offset:  len(shebang) + visitor.offsets[reqPath],
+				Message: fmt.Sprintf("%s requires itself through %q", path, reqPath),
+			})
+		}
+	}
+	// Warn about optional dependencies that will now fail at import time
+	for _, diagnostic := range visitor.tryRequires {
+		diagnostic.Offset += len(shebang)
+		diagnostics = append(diagnostics, diagnostic)
+	}
+
+	return &RewriteResult{
+		Code:         applyEdits(source, edits),
+		Edits:        edits,
+		RequireFuncs: requireFuncs,
+		Paths:        visitor.paths(),
+		Diagnostics:  diagnostics,
+	}, nil
+}
+
+// concatPattern matches a string literal followed by +, which may be a path
+// split across a concatenation like "/node_" + "modules/react"
+var concatPattern = regexp.MustCompile(`["'\x60]\s*\+`)
+
+// mayContainPrefix is a cheap, conservative pre-filter that only reports false
+// when the prefix doesn't appear anywhere in the source
+func mayContainPrefix(source string, opts RewriteOptions) bool {
+	if opts.ErrorOnESM {
+		return true // We need to parse to check for ESM syntax
+	} else if strings.Contains(source, "\\") {
+		return true // The prefix may be spelled with escapes or backslashes
+	} else if concatPattern.MatchString(source) {
+		return true // The prefix may be split across concatenated strings
+	}
+	return opts.Prefix == "" || strings.Contains(source, opts.Prefix)
+}
+
+// isSelfRequire reports whether the require path refers to the module at path,
+// ignoring extensions and index files
+func isSelfRequire(path, reqPath string) bool {
+	return trimModulePath(path) == trimModulePath(reqPath)
+}
+
+// trimModulePath cleans a module path and strips its extension and index file
+func trimModulePath(p string) string {
+	p = pathpkg.Clean(p)
+	switch pathpkg.Ext(p) {
+	case ".js", ".cjs", ".mjs":
+		p = strings.TrimSuffix(p, pathpkg.Ext(p))
+	}
+	return strings.TrimSuffix(p, "/index")
+}
+
+// hasESMSyntax reports whether the AST contains top-level import or export
+// statements. Dynamic import() and import.meta are allowed in CommonJS.
+func hasESMSyntax(ast *js.AST) bool {
+	for _, stmt := range ast.BlockStmt.List {
+		switch stmt.(type) {
+		case *js.ImportStmt, *js.ExportStmt:
+			return true
+		}
+	}
+	return false
+}
+
+// requireKey returns the __cjs_imports__ key for a require path
+func (opts RewriteOptions) requireKey(path string) string {
+	if opts.NormalizeSeparators {
+		path = strings.ReplaceAll(path, `\`, "/")
+	}
+	if opts.CanonicalizeIndex {
+		for _, suffix := range []string{"/index.js", "/index"} {
+			if trimmed := strings.TrimSuffix(path, suffix); trimmed != path && trimmed != "" {
+				path = trimmed
+				break
+			}
+		}
+	}
+	if opts.CanonicalizePaths {
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			path = trimmed
+		}
+	}
+	return path
+}
 
-	// Replace the require function calls with __cjs_require__ (use code without directives to avoid duplication)
-	replaced := replaceRequireCalls(codeWithoutDirectives, visitor.requireCalls, prefix)
+// stripPrefix removes the prefix from a matched path with StripPrefixInImport
+func (opts RewriteOptions) stripPrefix(path string) string {
+	if !opts.StripPrefixInImport {
+		return path
+	}
+	if stripped := strings.TrimLeft(strings.TrimPrefix(path, opts.Prefix), "/"); stripped != "" {
+		return stripped
+	}
+	return path
+}
 
-	// Combine: shebang + directives + infrastructure + modified code
-	return shebang + directives + infrastructure + replaced, nil
+// excludes reports whether a matched path should be left alone
+func (opts RewriteOptions) excludes(path string) bool {
+	for _, exclude := range opts.Exclude {
+		if path == exclude {
+			return true
+		}
+	}
+	return false
+}
+
+// importGroup returns the first path segment of an import after the prefix,
+// like "@babel" for "/node_modules/@babel/core"
+func (opts RewriteOptions) importGroup(source string) string {
+	rest := strings.TrimLeft(strings.TrimPrefix(source, opts.Prefix), "/")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[:i]
+	}
+	return rest
+}
+
+// remapPrefix swaps the longest prefix of path found in RemapPrefix
+func (opts RewriteOptions) remapPrefix(path string) string {
+	from := ""
+	found := false
+	for prefix := range opts.RemapPrefix {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(from)) {
+			from, found = prefix, true
+		}
+	}
+	if !found {
+		return path
+	}
+	return opts.RemapPrefix[from] + strings.TrimPrefix(path, from)
+}
+
+// importSource returns the module to import for a require path
+func (opts RewriteOptions) importSource(path string) string {
+	if opts.StripQuery {
+		if i := strings.IndexAny(path, "?#"); i >= 0 {
+			path = path[:i]
+		}
+	}
+	return path
 }
 
 type requireCall struct {
 	funcName string
-	path     string
+	path     string // Key into __cjs_imports__
+	// start and end offsets of the function name in the source
+	start, end int
+	// argStart and argEnd are the offsets of the path argument, which is
+	// rewritten when the key differs from the original path
+	argStart, argEnd int
+	rewriteArg       bool
+	// callEnd is the offset after the closing parenthesis, or -1 if unknown
+	callEnd int
 }
 
 type requireVisitor struct {
-	prefix       string
+	opts         RewriteOptions
+	src          []byte // Parser input, used to find offsets of AST nodes
 	requires     map[string]bool
+	offsets      map[string]int // Offset of the first occurrence of each path
 	requireCalls []requireCall
 	pathOrder    []string // Preserve order of first occurrence
+	matches      int      // Number of matched require calls
+	dynamicCalls []dynamicCall
+	requireVars  map[*js.Var]bool // Bindings of the matched require functions
+	varRefs      map[*js.Var]int  // Number of times each binding appears
+	varUses      map[*js.Var]int  // Appearances that don't use the binding as a value
+	tryBodies    map[*js.BlockStmt]bool
+	tryDepth     int                   // Number of enclosing try blocks
+	tryRequires  []Diagnostic          // Matched requires inside try blocks
+	namedCalls   map[*js.CallExpr]bool // Requires replaced by namedImports
+	namedImports []namedImport
+}
+
+// namedImport replaces a destructured require declaration with an import
+type namedImport struct {
+	path       string
+	start, end int // Span of the declaration, up to the closing parenthesis
+	stmt       string
+}
+
+// dynamicCall is a require-like call without a constant path
+type dynamicCall struct {
+	funcName string
+	code     string
+	offset   int // Offset of the callee, or -1 if unknown
 }
 
 func (v *requireVisitor) Enter(n js.INode) js.IVisitor {
+	v.countVarUses(n)
+	v.trackDynamicCall(n)
+	v.enterTry(n)
 	// Look for any CallExpr with 1 string argument starting with prefix
-	if call, ok := n.(*js.CallExpr); ok {
-		// Must have exactly 1 argument
-		if len(call.Args.List) == 1 {
-			// Argument must be a string literal
-			if lit, ok := call.Args.List[0].Value.(*js.LiteralExpr); ok {
-				pathStr := extractStringLiteral(lit)
-				// Only collect paths that start with prefix
-				if strings.HasPrefix(pathStr, v.prefix) {
+	if call, ok := n.(*js.CallExpr); ok && !v.namedCalls[call] {
+		// Must have exactly 1 argument, or at least 1 with AllowExtraArgs
+		if v.matchesArgCount(len(call.Args.List)) && !call.Args.List[0].Rest {
+			// Argument must be a string literal or a concatenation of them,
+			// possibly in parentheses like __require(("react"))
+			if rawPath, first, last, isString := constantString(unwrapGroup(call.Args.List[0].Value)); isString {
+				// Only collect paths that start with prefix and aren't excluded
+				if pathStr, ok := v.importPath(rawPath); ok && (v.tryDepth == 0 || !v.opts.KeepTryRequires) {
 					// Track first occurrence order
+					argStart := offsetOf(v.src, first.Data)
+					argEnd := offsetOf(v.src, last.Data) + len(last.Data)
+					if v.tryDepth > 0 {
+						v.tryRequires = append(v.tryRequires, Diagnostic{
+							Offset:  argStart,
+							Message: fmt.Sprintf("%q is required inside a try block, so hoisting it to an import throws at import time when it's missing", pathStr),
+						})
+					}
 					if !v.requires[pathStr] {
 						v.pathOrder = append(v.pathOrder, pathStr)
+						v.offsets[pathStr] = argStart
 					}
 					v.requires[pathStr] = true
+					v.matches++
 
 					// Track the function name for replacement
-					if funcName := v.getFunctionName(call); funcName != "" {
-						v.requireCalls = append(v.requireCalls, requireCall{
-							funcName: funcName,
-							path:     pathStr,
-						})
+					if x := calleeVar(call.X); x != nil {
+						v.requireVars[binding(x)] = true
+					}
+					if funcName := v.getFunctionName(call.X); funcName != "" {
+						if start, end, ok := calleeSpan(v.src, argStart, funcName); ok {
+							v.requireCalls = append(v.requireCalls, requireCall{
+								funcName:   funcName,
+								path:       pathStr,
+								start:      start,
+								end:        end,
+								argStart:   argStart,
+								argEnd:     argEnd,
+								rewriteArg: pathStr != rawPath,
+								callEnd:    closingParen(v.src, argEnd),
+							})
+						}
 					}
 				}
 			}
@@ -118,15 +618,655 @@ func (v *requireVisitor) Enter(n js.INode) js.IVisitor {
 	return v
 }
 
-func (v *requireVisitor) Exit(n js.INode) {}
+// importPath returns the __cjs_imports__ key for a require path, or false if
+// the path shouldn't be imported
+func (v *requireVisitor) importPath(rawPath string) (string, bool) {
+	pathStr := v.opts.requireKey(rawPath)
+	if v.opts.Resolve != nil {
+		if resolved, ok := v.opts.Resolve(rawPath); ok {
+			pathStr = v.opts.requireKey(resolved)
+		}
+	}
+	if !v.matchesPrefix(pathStr) || v.opts.excludes(pathStr) {
+		return "", false
+	}
+	return v.opts.remapPrefix(v.opts.stripPrefix(pathStr)), true
+}
+
+// findNamedImports finds top-level declarations like
+// `const { default: X, other } = __require("/node_modules/x")` that can
+// become named imports
+func (v *requireVisitor) findNamedImports(stmts []js.IStmt) {
+	for _, stmt := range stmts {
+		decl, ok := stmt.(*js.VarDecl)
+		if !ok || decl.TokenType != js.ConstToken || len(decl.List) != 1 {
+			continue
+		}
+		pattern, ok := decl.List[0].Binding.(*js.BindingObject)
+		if !ok || pattern.Rest != nil || len(pattern.List) == 0 {
+			continue
+		}
+		call, ok := decl.List[0].Default.(*js.CallExpr)
+		if !ok || len(call.Args.List) != 1 || call.Args.List[0].Rest || v.getFunctionName(call.X) == "" {
+			continue
+		}
+		rawPath, _, last, ok := constantString(unwrapGroup(call.Args.List[0].Value))
+		if !ok {
+			continue
+		}
+		pathStr, ok := v.importPath(rawPath)
+		if !ok {
+			continue
+		}
+		clause, ok := importClause(pattern)
+		if !ok {
+			continue
+		}
+		start := constStart(v.src, pattern)
+		end := closingParen(v.src, offsetOf(v.src, last.Data)+len(last.Data))
+		if start < 0 || end < 0 {
+			continue
+		}
+		v.namedCalls[call] = true
+		v.namedImports = append(v.namedImports, namedImport{
+			path:  pathStr,
+			start: start,
+			end:   end,
+			stmt:  fmt.Sprintf("import %s from %s", clause, quoteJS(v.opts.importSource(pathStr))),
+		})
+	}
+}
+
+// importClause returns the import clause for an object pattern, like
+// `X, { other, a as b }` for `{ default: X, other, a: b }`
+func importClause(pattern *js.BindingObject) (string, bool) {
+	defaultName := ""
+	var named []string
+	for _, item := range pattern.List {
+		local, ok := item.Value.Binding.(*js.Var)
+		if !ok || item.Value.Default != nil || item.Key == nil || item.Key.IsComputed() {
+			return "", false
+		}
+		name := string(item.Key.Literal.Data)
+		if item.Key.Literal.TokenType == js.StringToken {
+			if name, ok = stringLiteral(&item.Key.Literal); !ok {
+				return "", false
+			}
+		} else if !js.IsIdentifierName(item.Key.Literal.TokenType) {
+			return "", false
+		}
+		switch {
+		case name == "default":
+			if defaultName != "" {
+				return "", false
+			}
+			defaultName = string(local.Data)
+		case name == string(local.Data):
+			named = append(named, name)
+		case isIdentifierName(name):
+			named = append(named, name+" as "+string(local.Data))
+		default:
+			named = append(named, quoteJS(name)+" as "+string(local.Data))
+		}
+	}
+	clause := defaultName
+	if len(named) > 0 {
+		if clause != "" {
+			clause += ", "
+		}
+		clause += "{ " + strings.Join(named, ", ") + " }"
+	}
+	return clause, true
+}
+
+// constStart returns the offset of the const keyword before an object
+// pattern, or -1 if there's anything else in between, like a comment
+func constStart(src []byte, pattern *js.BindingObject) int {
+	first := pattern.List[0]
+	pos := offsetOf(src, first.Key.Literal.Data)
+	if local, ok := first.Value.Binding.(*js.Var); ok && pos < 0 {
+		pos = offsetOf(src, local.Data)
+	}
+	if pos < 0 {
+		return -1
+	}
+	before := bytes.TrimRight(src[:pos], " \t\r\n")
+	if !bytes.HasSuffix(before, []byte("{")) {
+		return -1
+	}
+	before = bytes.TrimRight(before[:len(before)-1], " \t\r\n")
+	if !bytes.HasSuffix(before, []byte("const")) {
+		return -1
+	}
+	return len(before) - len("const")
+}
+
+// paths returns the matched paths, including those of named imports, in the
+// order they first appear
+func (v *requireVisitor) paths() []string {
+	if len(v.namedImports) == 0 {
+		return v.pathOrder
+	}
+	first := make(map[string]int)
+	var paths []string
+	for _, named := range v.namedImports {
+		if _, ok := first[named.path]; !ok && !v.requires[named.path] {
+			first[named.path] = named.start
+			paths = append(paths, named.path)
+		}
+	}
+	for _, path := range v.pathOrder {
+		first[path] = v.offsets[path]
+	}
+	paths = append(paths, v.pathOrder...)
+	sort.SliceStable(paths, func(i, j int) bool {
+		return first[paths[i]] < first[paths[j]]
+	})
+	return paths
+}
 
-func (v *requireVisitor) getFunctionName(call *js.CallExpr) string {
-	if ident, ok := call.X.(*js.Var); ok {
-		return string(ident.Data)
+func (v *requireVisitor) Exit(n js.INode) {
+	if block, ok := n.(*js.BlockStmt); ok && v.tryBodies[block] {
+		v.tryDepth--
+	}
+}
+
+// enterTry tracks whether the visitor is inside the body of a try statement,
+// where a require may be an optional dependency. Catch and finally blocks
+// don't count.
+func (v *requireVisitor) enterTry(n js.INode) {
+	switch n := n.(type) {
+	case *js.TryStmt:
+		if n.Body != nil {
+			v.tryBodies[n.Body] = true
+		}
+	case *js.BlockStmt:
+		if v.tryBodies[n] {
+			v.tryDepth++
+		}
+	}
+}
+
+// trackDynamicCall records calls with a single non-constant argument, like
+// require(name), in case the callee turns out to be a require function
+func (v *requireVisitor) trackDynamicCall(n js.INode) {
+	call, ok := n.(*js.CallExpr)
+	if !ok {
+		return
+	}
+	funcName := v.getFunctionName(call.X)
+	if funcName == "" {
+		return
+	}
+	if len(call.Args.List) != 1 || call.Args.List[0].Rest {
+		return
+	}
+	if _, _, _, ok := constantString(unwrapGroup(call.Args.List[0].Value)); ok {
+		return
+	}
+	v.dynamicCalls = append(v.dynamicCalls, dynamicCall{funcName, jsString(call), v.callOffset(call, funcName)})
+}
+
+// checkStatic returns an error listing the calls to require, or to functions
+// used like require elsewhere in the file, whose paths aren't constant, along
+// with their offsets after a shebang of length base
+func (v *requireVisitor) checkStatic(path string, base int) error {
+	funcs := map[string]bool{"require": true}
+	for _, call := range v.requireCalls {
+		funcs[call.funcName] = true
+	}
+	// Calls that can't be told apart, like two calls to require(name) in the
+	// same scope, may find the same offset, which then belongs to neither
+	claims := make(map[int]int)
+	for _, call := range v.dynamicCalls {
+		claims[call.offset]++
+	}
+	var calls []string
+	for _, call := range v.dynamicCalls {
+		if !funcs[call.funcName] {
+			continue
+		}
+		if call.offset < 0 || claims[call.offset] > 1 {
+			calls = append(calls, call.code)
+		} else {
+			calls = append(calls, fmt.Sprintf("%s at offset %d", call.code, base+call.offset))
+		}
+	}
+	if len(calls) == 0 {
+		return nil
+	}
+	return fmt.Errorf("cjs: %s has requires that can't be imported statically: %s", path, strings.Join(calls, ", "))
+}
+
+// callOffset returns the offset of the callee of a call to funcName, or -1 if
+// it can't be found. Variables are shared between uses in a scope and point at
+// their first appearance, so the call is found from its first argument or its
+// callee, whichever appears here first.
+func (v *requireVisitor) callOffset(call *js.CallExpr, funcName string) int {
+	arg := leftmostExpr(call.Args.List[0].Value)
+	argStart := -1
+	switch arg := arg.(type) {
+	case *js.LiteralExpr:
+		argStart = offsetOf(v.src, arg.Data)
+	case *js.TemplateExpr:
+		if arg.Tag == nil && len(arg.List) > 0 {
+			argStart = offsetOf(v.src, arg.List[0].Value)
+		} else if arg.Tag == nil {
+			argStart = offsetOf(v.src, arg.Tail)
+		}
+	case *js.Var:
+		argStart = offsetOf(v.src, arg.Data)
+	}
+	// Step back from the argument, like for require(name)
+	if start := calleeStart(v.src, argStart, funcName); start >= 0 {
+		return start
+	}
+	// Step forward from the callee, like for require(x) where x is declared
+	// earlier, checking that the argument follows
+	name, ok := arg.(*js.Var)
+	root := calleeVar(call.X)
+	if dot, isDot := call.X.(*js.DotExpr); isDot {
+		root = memberRoot(dot)
+	}
+	if !ok || root == nil {
+		return -1
+	}
+	start := offsetOf(v.src, root.Data)
+	if start < 0 || !bytes.HasPrefix(v.src[start:], []byte(funcName)) {
+		return -1
+	}
+	pos := skipForward(v.src, start+len(funcName), ')')
+	if bytes.HasPrefix(v.src[pos:], []byte("?.")) {
+		pos = skipForward(v.src, pos+2, 0)
+	}
+	if pos >= len(v.src) || v.src[pos] != '(' {
+		return -1
+	}
+	pos = skipForward(v.src, pos, '(')
+	end := pos + len(name.Data)
+	if !bytes.HasPrefix(v.src[pos:], name.Data) || (end < len(v.src) && isIdentifierByte(v.src[end])) {
+		return -1
+	}
+	return start
+}
+
+// leftmostExpr returns the expression whose source comes first in expr, like
+// a in a + "b"
+func leftmostExpr(expr js.IExpr) js.IExpr {
+	switch x := expr.(type) {
+	case *js.BinaryExpr:
+		return leftmostExpr(x.X)
+	case *js.CondExpr:
+		return leftmostExpr(x.Cond)
+	case *js.GroupExpr:
+		return leftmostExpr(x.X)
+	case *js.CommaExpr:
+		if len(x.List) > 0 {
+			return leftmostExpr(x.List[0])
+		}
+	case *js.DotExpr:
+		return leftmostExpr(x.X)
+	case *js.IndexExpr:
+		return leftmostExpr(x.X)
+	case *js.CallExpr:
+		return leftmostExpr(x.X)
+	}
+	return expr
+}
+
+// memberRoot returns the variable at the start of a member expression, like
+// a in a.b.c
+func memberRoot(dot *js.DotExpr) *js.Var {
+	switch x := dot.X.(type) {
+	case *js.Var:
+		return x
+	case *js.DotExpr:
+		return memberRoot(x)
+	}
+	return nil
+}
+
+// calleeStart returns the offset of the callee name before a call's first
+// argument at argStart, like calleeSpan, or -1 if name isn't called there.
+// It also steps back over an optional call like require?.(x).
+func calleeStart(src []byte, argStart int, name string) int {
+	if argStart < 0 {
+		return -1
+	}
+	end := skipBackward(src, argStart, '(')
+	if bytes.HasSuffix(src[:end], []byte("?.")) {
+		end -= 2
+	}
+	end = skipBackward(src, end, ')')
+	start := end - len(name)
+	if start < 0 || string(src[start:end]) != name || (start > 0 && isIdentifierByte(src[start-1])) {
+		return -1
+	}
+	// Skip member calls like a.require(x) and constructors like new require(x)
+	before := skipBackward(src, start, 0)
+	if before > 0 && src[before-1] == '.' {
+		return -1
+	}
+	if bytes.HasSuffix(src[:before], []byte("new")) && (before == 3 || !isIdentifierByte(src[before-4])) {
+		return -1
+	}
+	return start
+}
+
+// skipForward moves pos forward over whitespace, block comments and c
+func skipForward(src []byte, pos int, c byte) int {
+	for pos < len(src) {
+		switch src[pos] {
+		case ' ', '\t', '\n', '\r', c:
+			pos++
+		case '/':
+			// Skip a block comment starting at pos
+			if pos+1 >= len(src) || src[pos+1] != '*' {
+				return pos
+			}
+			end := bytes.Index(src[pos+2:], []byte("*/"))
+			if end < 0 {
+				return pos
+			}
+			pos += 2 + end + 2
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// countVarUses counts the appearances of bindings, separating out those that
+// don't reference the variable's value: calls, declarations, assignments,
+// typeof checks and member accesses like require.resolve. Variables share a
+// *js.Var across appearances, so appearances are counted rather than marked.
+func (v *requireVisitor) countVarUses(n js.INode) {
+	use := func(expr js.INode) {
+		if x, ok := expr.(*js.Var); ok {
+			v.varUses[binding(x)]++
+		}
+	}
+	switch n := n.(type) {
+	case *js.Var:
+		v.varRefs[binding(n)]++
+	case *js.CallExpr:
+		if x := calleeVar(n.X); x != nil {
+			v.varUses[binding(x)]++
+		}
+	case *js.DotExpr:
+		use(n.X)
+	case *js.IndexExpr:
+		use(n.X)
+	case *js.BindingElement:
+		use(n.Binding)
+	case *js.FuncDecl:
+		if n.Name != nil {
+			use(n.Name)
+		}
+	case *js.ClassDecl:
+		if n.Name != nil {
+			use(n.Name)
+		}
+	case *js.Params:
+		use(n.Rest)
+	case *js.BinaryExpr:
+		if n.Op == js.EqToken {
+			use(n.X)
+		}
+	case *js.UnaryExpr:
+		if n.Op == js.TypeofToken {
+			use(n.X)
+		}
+	}
+}
+
+// bareReferences warns about require functions that are referenced without
+// being called, like arr.map(__require), which can't become static imports.
+// The offset is the first bare reference, or -1 if it can't be found.
+func (v *requireVisitor) bareReferences(base int) (diagnostics []Diagnostic) {
+	counts := make(map[string]int) // Bare references to each name
+	bindings := make(map[string]int)
+	for x := range v.requireVars {
+		counts[string(x.Data)] += v.varRefs[x] - v.varUses[x]
+		bindings[string(x.Data)]++
+	}
+	for x := range v.requireVars {
+		n := v.varRefs[x] - v.varUses[x]
+		if n <= 0 {
+			continue
+		}
+		// Tokens don't know about scopes, so only trust them when they find
+		// the same number of bare references as the syntax tree
+		offset := -1
+		name := string(x.Data)
+		if sites := bareSites(v.src, name); bindings[name] == 1 && len(sites) == counts[name] {
+			offset = base + sites[0]
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Offset:  offset,
+			Message: fmt.Sprintf("%s is referenced %d time(s) without being called, so those requires can't be rewritten", x.Data, n),
+		})
+	}
+	sort.Slice(diagnostics, func(i, j int) bool {
+		return diagnostics[i].Message < diagnostics[j].Message
+	})
+	return diagnostics
+}
+
+// bareSites returns the offsets in src where name appears as a value, skipping
+// the appearances that countVarUses doesn't count, like calls, declarations,
+// assignments, typeof checks, member accesses and property names
+func bareSites(src []byte, name string) []int {
+	pos := 0
+	if bytes.HasPrefix(src, []byte("#!")) {
+		// The lexer doesn't understand a shebang kept with KeepShebang
+		if pos = bytes.IndexByte(src, '\n'); pos < 0 {
+			return nil
+		}
+	}
+	type token struct {
+		tt     js.TokenType
+		data   string
+		offset int
+	}
+	var tokens []token // Significant tokens
+	lexer := js.NewLexer(parse.NewInputString(string(src[pos:])))
+	for {
+		tt, data := lexer.Next()
+		if tt == js.ErrorToken {
+			break
+		} else if (tt == js.DivToken || tt == js.DivEqToken) && (len(tokens) == 0 || !endsExpression(tokens[len(tokens)-1].tt)) {
+			tt, data = lexer.RegExp()
+		}
+		offset := pos
+		pos += len(data)
+		switch tt {
+		case js.WhitespaceToken, js.LineTerminatorToken, js.CommentToken, js.CommentLineTerminatorToken:
+			continue
+		}
+		tokens = append(tokens, token{tt, string(data), offset})
+	}
+	tokenType := func(i int) js.TokenType {
+		if i < 0 || i >= len(tokens) {
+			return js.ErrorToken
+		}
+		return tokens[i].tt
+	}
+	var sites []int
+	for i, tok := range tokens {
+		if tok.tt != js.IdentifierToken || tok.data != name {
+			continue
+		}
+		prev, next, after := tokenType(i-1), tokenType(i+1), tokenType(i+2)
+		switch prev {
+		case js.DotToken, js.OptChainToken, js.TypeofToken, js.VarToken, js.LetToken, js.ConstToken, js.FunctionToken, js.ClassToken:
+			continue
+		}
+		switch next {
+		case js.OpenParenToken, js.DotToken, js.OptChainToken, js.OpenBracketToken, js.EqToken:
+			continue
+		case js.CloseParenToken:
+			// Grouped callees like (0, name)(x) and parameters like (name) => {}
+			if after == js.OpenParenToken || after == js.OpenBraceToken || after == js.ArrowToken {
+				continue
+			}
+		case js.ColonToken:
+			// Property names like { name: x }, but not c ? name : x
+			if prev != js.QuestionToken {
+				continue
+			}
+		}
+		sites = append(sites, tok.offset)
+	}
+	return sites
+}
+
+// constantString folds a string literal or a concatenation of string literals
+// like "/node_modules/" + "react" into its value, returning the first and last
+// literals
+func constantString(expr js.IExpr) (value string, first, last *js.LiteralExpr, ok bool) {
+	switch expr := expr.(type) {
+	case *js.LiteralExpr:
+		value, ok = stringLiteral(expr)
+		return value, expr, expr, ok
+	case *js.BinaryExpr:
+		if expr.Op != js.AddToken {
+			return "", nil, nil, false
+		}
+		left, first, _, ok := constantString(expr.X)
+		if !ok {
+			return "", nil, nil, false
+		}
+		right, _, last, ok := constantString(expr.Y)
+		if !ok {
+			return "", nil, nil, false
+		}
+		return left + right, first, last, true
+	}
+	return "", nil, nil, false
+}
+
+// matchesArgCount reports whether a call with n arguments can be a require
+func (v *requireVisitor) matchesArgCount(n int) bool {
+	return n == 1 || (n > 1 && v.opts.AllowExtraArgs)
+}
+
+// matchesPrefix reports whether the require path should be rewritten
+func (v *requireVisitor) matchesPrefix(path string) bool {
+	prefix := v.opts.Prefix
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if v.opts.PlainPrefix || prefix == "" || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	// The prefix must end at a path segment boundary
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// getFunctionName finds the name of the function being called, unwrapping
+// minifier patterns like (__require)(...) and (0, __require)(...). Namespaced
+// helpers like __runtime.require are named by their full member expression.
+func (v *requireVisitor) getFunctionName(callee js.IExpr) string {
+	switch x := callee.(type) {
+	case *js.Var, *js.DotExpr:
+		return memberName(x)
+	case *js.GroupExpr:
+		return v.getFunctionName(x.X)
+	case *js.CommaExpr:
+		if len(x.List) > 0 {
+			return v.getFunctionName(x.List[len(x.List)-1])
+		}
+	}
+	return ""
+}
+
+// memberName returns the text of a member expression like a.b.c, or "" if it
+// isn't a chain of plain property accesses
+func memberName(expr js.IExpr) string {
+	switch x := expr.(type) {
+	case *js.Var:
+		return string(x.Data)
+	case *js.DotExpr:
+		object := memberName(x.X)
+		if object == "" || x.Optional {
+			return ""
+		}
+		if prop, ok := x.Y.(js.LiteralExpr); ok {
+			return object + "." + string(prop.Data)
+		}
 	}
 	return ""
 }
 
+// calleeVar finds the variable being called, if any
+func calleeVar(callee js.IExpr) *js.Var {
+	switch x := callee.(type) {
+	case *js.Var:
+		return x
+	case *js.GroupExpr:
+		return calleeVar(x.X)
+	case *js.CommaExpr:
+		if len(x.List) > 0 {
+			return calleeVar(x.List[len(x.List)-1])
+		}
+	}
+	return nil
+}
+
+// offsetOf returns the offset of data within src, or -1 if data doesn't point
+// into src. The parser's AST keeps slices of its input buffer, which lets us
+// recover source positions that the parser doesn't track itself.
+func offsetOf(src, data []byte) int {
+	if len(data) == 0 || len(src) == 0 {
+		return -1
+	}
+	offset := int(uintptr(unsafe.Pointer(unsafe.SliceData(data))) - uintptr(unsafe.Pointer(unsafe.SliceData(src))))
+	if offset < 0 || offset+len(data) > len(src) {
+		return -1
+	}
+	return offset
+}
+
+// calleeSpan finds the span of the callee name before a call's first argument
+// at argStart. It steps back over the opening parenthesis, along with any
+// grouping parentheses around the callee like in (0, __require)("...").
+func calleeSpan(src []byte, argStart int, name string) (int, int, bool) {
+	if argStart < 0 {
+		return 0, 0, false
+	}
+	end := skipBackward(src, argStart, '(')
+	end = skipBackward(src, end, ')')
+	start := end - len(name)
+	if start < 0 || string(src[start:end]) != name {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// skipBackward moves pos back over whitespace, block comments and c
+func skipBackward(src []byte, pos int, c byte) int {
+	for pos > 0 {
+		switch src[pos-1] {
+		case ' ', '\t', '\n', '\r', c:
+			pos--
+		case '/':
+			// Skip a block comment ending at pos
+			if pos < 2 || src[pos-2] != '*' {
+				return pos
+			}
+			open := bytes.LastIndex(src[:pos-2], []byte("/*"))
+			if open < 0 {
+				return pos
+			}
+			pos = open
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
 // pathToImportName converts a path like "/node_modules/react" to "__cjs_import_react__"
 func pathToImportName(path string) string {
 	// Get the last segment of the path
@@ -155,57 +1295,85 @@ func pathToImportName(path string) string {
 	return "__cjs_import_" + lastName + "__"
 }
 
-// replaceRequireCalls replaces require function calls with __cjs_require__
-func replaceRequireCalls(source string, calls []requireCall, prefix string) string {
-	// Build patterns for each require call we found
-	// Replace funcName("path") with __cjs_require__("path")
-	result := source
+// Edit replaces source[Start:End] with Replacement
+type Edit struct {
+	Start, End  int
+	Replacement string
+}
 
-	// Group calls by function name to build regex patterns
-	funcToPaths := make(map[string][]string)
+// requireEdits returns the edits that turn require calls into __cjs_require__
+// calls, also rewriting paths that differ from their key. Offsets are shifted
+// by base.
+func requireEdits(calls []requireCall, base int, annotate bool) []Edit {
+	edits := make([]Edit, 0, len(calls))
 	for _, call := range calls {
-		funcToPaths[call.funcName] = append(funcToPaths[call.funcName], call.path)
-	}
-
-	// For each function name, replace its calls
-	for funcName := range funcToPaths {
-		// Use regex to match function calls: funcName("...")
-		// We need to escape special regex characters in the function name
-		escapedFunc := regexp.QuoteMeta(funcName)
-		pattern := escapedFunc + `\s*\(\s*(["\'])` + regexp.QuoteMeta(prefix)
-		re := regexp.MustCompile(pattern)
-
-		// Replace with __cjs_require__(
-		result = re.ReplaceAllStringFunc(result, func(match string) string {
-			// Extract the quote character
-			re2 := regexp.MustCompile(escapedFunc + `\s*\(\s*(["\'])`)
-			quoteMatch := re2.FindStringSubmatch(match)
-			if len(quoteMatch) > 1 {
-				return "__cjs_require__(" + quoteMatch[1] + prefix
-			}
-			return "__cjs_require__(\"" + prefix
-		})
+		replacement := "__cjs_require__"
+		annotation := fmt.Sprintf(" /* was %s */", call.funcName)
+		if annotate && call.callEnd < 0 {
+			// Annotate the function name when the end of the call is unknown
+			replacement += annotation
+		}
+		edits = append(edits, Edit{base + call.start, base + call.end, replacement})
+		if call.rewriteArg {
+			edits = append(edits, Edit{base + call.argStart, base + call.argEnd, quoteJS(call.path)})
+		}
+		if annotate && call.callEnd >= 0 {
+			edits = append(edits, Edit{base + call.callEnd, base + call.callEnd, annotation})
+		}
+	}
+	return edits
+}
+
+// inlineEdits returns the edits that replace whole require calls with their
+// import binding. It reports false when a call can't be replaced as a whole,
+// like `(0, __require)("x")`.
+func inlineEdits(src []byte, calls []requireCall, importValues map[string]string, base int, annotate bool) ([]Edit, bool) {
+	edits := make([]Edit, 0, len(calls))
+	for _, call := range calls {
+		if call.callEnd < 0 || !isOpenParen(src[call.end:call.argStart]) {
+			return nil, false
+		}
+		replacement := importValues[call.path]
+		if annotate {
+			replacement += fmt.Sprintf(" /* was %s */", call.funcName)
+		}
+		edits = append(edits, Edit{base + call.start, base + call.callEnd, replacement})
 	}
+	return edits, true
+}
 
-	return result
+// isOpenParen reports whether src is a single opening parenthesis surrounded
+// by whitespace
+func isOpenParen(src []byte) bool {
+	return string(bytes.TrimSpace(src)) == "("
 }
 
-// extractStringLiteral extracts the string value from a literal expression
-func extractStringLiteral(lit *js.LiteralExpr) string {
-	data := string(lit.Data)
-	// Remove quotes
-	if len(data) >= 2 {
-		if (data[0] == '"' && data[len(data)-1] == '"') ||
-			(data[0] == '\'' && data[len(data)-1] == '\'') {
-			return data[1 : len(data)-1]
+// applyEdits applies the edits to the source in order, skipping any edit that
+// overlaps a previous one
+func applyEdits(source string, edits []Edit) string {
+	sorted := make([]Edit, len(edits))
+	copy(sorted, edits)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var result strings.Builder
+	pos := 0
+	for _, e := range sorted {
+		if e.Start < pos {
+			continue // Overlapping edit
 		}
+		result.WriteString(source[pos:e.Start])
+		result.WriteString(e.Replacement)
+		pos = e.End
 	}
-	return data
+	result.WriteString(source[pos:])
+	return result.String()
 }
 
 // extractDirectivesString extracts directive prologues from the source
-// Returns the directive strings and the source without directives
-func extractDirectivesString(ast *js.AST, source string) (string, string) {
+// Returns the directive strings and the offset where the code after them starts
+func extractDirectivesString(ast *js.AST, source string) (string, int) {
 	var directives strings.Builder
 	directiveCount := 0
 
@@ -224,16 +1392,26 @@ func extractDirectivesString(ast *js.AST, source string) (string, string) {
 		}
 	}
 
-	// If no directives, return as-is
-	if directiveCount == 0 {
-		return "", source
+	// If no directives, return as-is. The parser accepts a hashbang at the
+	// start with KeepShebang, which has to stay first.
+	hashbang := strings.HasPrefix(source, "#!")
+	if directiveCount == 0 && !hashbang {
+		return "", 0
 	}
 
 	// Extract directive strings from source
 	pos := 0
 	foundDirectives := 0
+	if hashbang {
+		pos = len(source)
+		if end := strings.IndexAny(source, "\r\n"); end >= 0 {
+			pos = end
+		}
+		directives.WriteString(source[:pos])
+		directives.WriteString("\n")
+	}
 
-	for foundDirectives < directiveCount && pos < len(source) {
+	for pos < len(source) {
 		// Skip whitespace
 		for pos < len(source) && (source[pos] == ' ' || source[pos] == '\t' || source[pos] == '\n' || source[pos] == '\r') {
 			pos++
@@ -243,6 +1421,18 @@ func extractDirectivesString(ast *js.AST, source string) (string, string) {
 			break
 		}
 
+		// Keep comments around the directives in place, before the injected code
+		if end := commentEnd(source, pos); end > pos {
+			directives.WriteString(source[pos:end])
+			directives.WriteString("\n")
+			pos = end
+			continue
+		}
+
+		if foundDirectives == directiveCount {
+			break
+		}
+
 		// Look for string literal (directive)
 		if source[pos] == '"' || source[pos] == '\'' {
 			quote := source[pos]
@@ -275,10 +1465,56 @@ func extractDirectivesString(ast *js.AST, source string) (string, string) {
 		}
 	}
 
-	// Skip any trailing whitespace/newlines after directives
-	for pos < len(source) && (source[pos] == ' ' || source[pos] == '\t' || source[pos] == '\n' || source[pos] == '\r') {
-		pos++
+	return directives.String(), pos
+}
+
+// closingParen returns the offset after the parenthesis closing a call whose
+// last argument ends at pos, or -1 if it isn't found
+func closingParen(src []byte, pos int) int {
+	if pos < 0 {
+		return -1
 	}
+	for pos < len(src) {
+		switch {
+		case src[pos] == ' ' || src[pos] == '\t' || src[pos] == '\n' || src[pos] == '\r' || src[pos] == ',':
+			pos++
+		case bytes.HasPrefix(src[pos:], []byte("/*")):
+			end := bytes.Index(src[pos+2:], []byte("*/"))
+			if end < 0 {
+				return -1
+			}
+			pos += 2 + end + 2
+		case bytes.HasPrefix(src[pos:], []byte("//")):
+			end := bytes.IndexByte(src[pos:], '\n')
+			if end < 0 {
+				return -1
+			}
+			pos += end
+		case src[pos] == ')':
+			return pos + 1
+		default:
+			return -1
+		}
+	}
+	return -1
+}
 
-	return directives.String(), source[pos:]
+// commentEnd returns the end of the line or block comment starting at pos,
+// or pos if there's no comment there
+func commentEnd(source string, pos int) int {
+	if !strings.HasPrefix(source[pos:], "/") || pos+1 >= len(source) {
+		return pos
+	}
+	switch source[pos+1] {
+	case '/':
+		if end := strings.IndexByte(source[pos:], '\n'); end >= 0 {
+			return pos + end
+		}
+		return len(source)
+	case '*':
+		if end := strings.Index(source[pos+2:], "*/"); end >= 0 {
+			return pos + 2 + end + 2
+		}
+	}
+	return pos
 }
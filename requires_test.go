@@ -1,6 +1,9 @@
 package cjs_test
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/matryer/is"
@@ -269,3 +272,1205 @@ func TestReactDom(t *testing.T) {
 		});
 	`)
 }
+
+func TestPrefixBoundary(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var backup = __require("/node_modules_backup/react");
+		var react = __require("/node_modules/react");
+	`, cjs.DefaultRewriteOptions("/node_modules"))
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var backup = __require("/node_modules_backup/react");
+		var react = __cjs_require__("/node_modules/react");
+	`)
+}
+
+func TestPlainPrefix(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var backup = __require("/node_modules_backup/react");
+	`, cjs.RewriteOptions{Prefix: "/node_modules", PlainPrefix: true})
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules_backup/react"
+		const __cjs_imports__ = {
+			"/node_modules_backup/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var backup = __cjs_require__("/node_modules_backup/react");
+	`)
+}
+
+func TestSequenceRequire(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", `
+		var React = (0, __require)("/node_modules/react");
+		var ReactDOM = (__require)("/node_modules/react-dom");
+	`)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = (0, __cjs_require__)("/node_modules/react");
+		var ReactDOM = (__cjs_require__)("/node_modules/react-dom");
+	`)
+}
+
+func TestParenthesizedRequire(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", `
+		var React = __require(("/node_modules/react"));
+		var ReactDOM = __require( ( ("/node_modules/react-dom") ) );
+	`)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__(("/node_modules/react"));
+		var ReactDOM = __cjs_require__( ( ("/node_modules/react-dom") ) );
+	`)
+}
+
+func TestRequireQuery(t *testing.T) {
+	is := is.New(t)
+	source := `
+		var a = __require("/node_modules/react");
+		var b = __require("/node_modules/react?commonjs-external");
+		var c = __require("/node_modules/react#fragment");
+	`
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_commonjs_external__ from "/node_modules/react?commonjs-external"
+		import __cjs_import_react_fragment__ from "/node_modules/react#fragment"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react?commonjs-external": __cjs_import_react_commonjs_external__,
+			"/node_modules/react#fragment": __cjs_import_react_fragment__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+		var b = __cjs_require__("/node_modules/react?commonjs-external");
+		var c = __cjs_require__("/node_modules/react#fragment");
+	`)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.StripQuery = true
+	actual, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react?commonjs-external": __cjs_import_react__,
+			"/node_modules/react#fragment": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+		var b = __cjs_require__("/node_modules/react?commonjs-external");
+		var c = __cjs_require__("/node_modules/react#fragment");
+	`)
+}
+
+func BenchmarkRewriteRequiresNoRequires(b *testing.B) {
+	source := strings.Repeat("var x = foo(1), y = { a: [x, 'str'] };\nfunction f(a) { return a + 1 }\n", 5000)
+	b.Run("parse", func(b *testing.B) {
+		// Mentioning the prefix forces a full parse
+		source := "// /node_modules/\n" + source
+		for b.Loop() {
+			if _, err := cjs.RewriteRequires("bench.js", "/node_modules/", source); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := cjs.RewriteRequires("bench.js", "/node_modules/", source); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestErrorOnESM(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.ErrorOnESM = true
+	_, err := cjs.RewriteRequiresWith("test.js", `
+		import x from "x";
+		var React = __require("/node_modules/react");
+		export { React };
+	`, opts)
+	is.True(err != nil)
+	is.Equal(err.Error(), "cjs: test.js already contains ESM syntax")
+	// Dynamic imports and import.meta are fine
+	_, err = cjs.RewriteRequiresWith("test.js", `
+		var React = __require("/node_modules/react");
+		import("./lazy.js");
+		console.log(import.meta.url);
+	`, opts)
+	is.NoErr(err)
+}
+
+func TestRewriteRequiresResult(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.RewriteRequiresResult("test.js", `
+		var a = __require("/node_modules/a");
+		var b = myRequire("/node_modules/b");
+		var a2 = (0, __require)("/node_modules/a");
+		var c = require2("/node_modules/c");
+		var local = other("./local");
+	`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.RequireFuncs, []string{"__require", "myRequire", "require2"})
+	is.Equal(result.Paths, []string{"/node_modules/a", "/node_modules/b", "/node_modules/c"})
+	code, err := cjs.RewriteRequiresWith("test.js", `
+		var a = __require("/node_modules/a");
+	`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	result, err = cjs.RewriteRequiresResult("test.js", `
+		var a = __require("/node_modules/a");
+	`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.Code, code)
+}
+
+func TestDirectiveComments(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", `"use strict"; /* banner */ var x = __require("/node_modules/x");`)
+	is.NoErr(err)
+	is.Equal(actual, `"use strict";
+/* banner */
+import __cjs_import_x__ from "/node_modules/x"
+const __cjs_imports__ = {
+	"/node_modules/x": __cjs_import_x__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+var x = __cjs_require__("/node_modules/x");`)
+	actual, err = cjs.RewriteRequires("test.js", "/node_modules/", `"use strict"; // explain
+/**
+ * @license MIT
+ */
+var x = __require("/node_modules/x");
+`)
+	is.NoErr(err)
+	is.Equal(actual, `"use strict";
+// explain
+/**
+ * @license MIT
+ */
+import __cjs_import_x__ from "/node_modules/x"
+const __cjs_imports__ = {
+	"/node_modules/x": __cjs_import_x__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+var x = __cjs_require__("/node_modules/x");
+`)
+}
+
+func TestDirectiveAfterComments(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", `// Copyright
+/* banner */
+"use strict";
+var x = __require("/node_modules/x");
+`)
+	is.NoErr(err)
+	is.Equal(actual, `// Copyright
+/* banner */
+"use strict";
+import __cjs_import_x__ from "/node_modules/x"
+const __cjs_imports__ = {
+	"/node_modules/x": __cjs_import_x__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+var x = __cjs_require__("/node_modules/x");
+`)
+}
+
+func TestSortImports(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.SortImports = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var Scheduler = __require("/node_modules/scheduler");
+		var React = __require("/node_modules/react");
+		var ReactDOM = __require("/node_modules/react-dom");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		import __cjs_import_scheduler__ from "/node_modules/scheduler"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+			"/node_modules/scheduler": __cjs_import_scheduler__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var Scheduler = __cjs_require__("/node_modules/scheduler");
+		var React = __cjs_require__("/node_modules/react");
+		var ReactDOM = __cjs_require__("/node_modules/react-dom");
+	`)
+}
+
+func TestNormalizeSeparators(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.NormalizeSeparators = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = __require("\\node_modules\\react");
+		var ReactDOM = __require("/node_modules\\react-dom");
+		var React2 = __require("/node_modules/react");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/node_modules/react");
+		var ReactDOM = __cjs_require__("/node_modules/react-dom");
+		var React2 = __cjs_require__("/node_modules/react");
+	`)
+}
+
+func TestNestedRequires(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", "var a = styled(__require(\"/node_modules/x\").default)({ color: 'red' });\n"+
+		"var b = tag`before ${__require(\"/node_modules/y\")} after`;\n"+
+		"var c = wrap(fn(__require( '/node_modules/x' )), other);\n")
+	is.NoErr(err)
+	is.Equal(actual, `import __cjs_import_x__ from "/node_modules/x"
+import __cjs_import_y__ from "/node_modules/y"
+const __cjs_imports__ = {
+	"/node_modules/x": __cjs_import_x__,
+	"/node_modules/y": __cjs_import_y__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+var a = styled(__cjs_require__("/node_modules/x").default)({ color: 'red' });
+var b = tag`+"`before ${__cjs_require__(\"/node_modules/y\")} after`"+`;
+var c = wrap(fn(__cjs_require__( '/node_modules/x' )), other);
+`)
+}
+
+func TestSelfRequire(t *testing.T) {
+	is := is.New(t)
+	source := `var self = __require("/node_modules/self");
+var react = __require("/node_modules/react");
+`
+	result, err := cjs.RewriteRequiresResult("/node_modules/self/index.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 1)
+	is.Equal(result.Diagnostics[0].Offset, strings.Index(source, `"/node_modules/self"`))
+	is.Equal(result.Diagnostics[0].Message, `/node_modules/self/index.js requires itself through "/node_modules/self"`)
+	// The transform still happens
+	is.Equal(result.Paths, []string{"/node_modules/self", "/node_modules/react"})
+	result, err = cjs.RewriteRequiresResult("/node_modules/other.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 0)
+}
+
+func TestBareRequireReference(t *testing.T) {
+	is := is.New(t)
+	source := `var __require = (x) => require(x);
+var react = __require("/node_modules/react");
+var mods = ["/node_modules/a", "/node_modules/b"].map(__require);
+if (typeof __require === "function") __require = null;
+`
+	result, err := cjs.RewriteRequiresResult("test.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: strings.Index(source, "__require)"), Message: "__require is referenced 1 time(s) without being called, so those requires can't be rewritten"},
+	})
+	// The bare reference is left alone
+	is.True(strings.Contains(result.Code, ".map(__require)"))
+	// Offsets include the shebang
+	shebang := "#!/usr/bin/env node\n"
+	result, err = cjs.RewriteRequiresResult("test.js", shebang+source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 1)
+	is.Equal(result.Diagnostics[0].Offset, len(shebang)+strings.Index(source, "__require)"))
+	result, err = cjs.RewriteRequiresResult("test.js", `var react = __require("/node_modules/react");`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 0)
+	// References in nested functions share the binding
+	source = `__require("/node_modules/a"); function f() { return arr.map(__require) }`
+	result, err = cjs.RewriteRequiresResult("test.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{Offset: strings.Index(source, "__require)"), Message: "__require is referenced 1 time(s) without being called, so those requires can't be rewritten"},
+	})
+	// Member accesses aren't bare references
+	source = `var a = require("/node_modules/a"); var p = require.resolve("/node_modules/b"), c = require["cache"];`
+	result, err = cjs.RewriteRequiresResult("test.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 0)
+}
+
+func TestAllowExtraArgs(t *testing.T) {
+	is := is.New(t)
+	source := `
+		var a = __webpack_require__("/node_modules/react", { cache: false });
+		var b = __webpack_require__(...["/node_modules/react-dom"]);
+	`
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	is.Equal(actual, source)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.AllowExtraArgs = true
+	actual, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react", { cache: false });
+		var b = __webpack_require__(...["/node_modules/react-dom"]);
+	`)
+}
+
+func TestRequireShebangAfterBOM(t *testing.T) {
+	is := is.New(t)
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", "\n\ufeff#!/usr/bin/env node\nvar fs = __require(\"/node_modules/fs-extra\");\n")
+	is.NoErr(err)
+	is.Equal(actual, "\n\ufeff#!/usr/bin/env node\n"+
+		"import __cjs_import_fs_extra__ from \"/node_modules/fs-extra\"\n"+
+		"const __cjs_imports__ = {\n"+
+		"\t\"/node_modules/fs-extra\": __cjs_import_fs_extra__,\n"+
+		"}\n"+
+		"function __cjs_require__(path) {\n"+
+		"\tconst req = __cjs_imports__[path]\n"+
+		"\tif (!req) {\n"+
+		"\t\tthrow new Error(\"Module not found: \" + path)\n"+
+		"\t}\n"+
+		"\treturn req\n"+
+		"}\n"+
+		"var fs = __cjs_require__(\"/node_modules/fs-extra\");\n")
+}
+
+func TestRequireShebangOnlyFirstLine(t *testing.T) {
+	is := is.New(t)
+	source := "#!/bin/sh\n/*\n#!/usr/bin/env node\n*/\nvar fs = __require(\"/node_modules/fs-extra\");\n"
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	is.True(strings.HasPrefix(actual, "#!/bin/sh\nimport __cjs_import_fs_extra__"))
+	is.True(strings.HasSuffix(actual, "\n/*\n#!/usr/bin/env node\n*/\nvar fs = __cjs_require__(\"/node_modules/fs-extra\");\n"))
+}
+
+func TestRewriteRequiresEdits(t *testing.T) {
+	is := is.New(t)
+	source := `#!/usr/bin/env node
+"use strict";
+var a = __require("/node_modules/react");
+var b = (0, require2)("/node_modules/react-dom");
+`
+	edits, err := cjs.RewriteRequiresEdits("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	is.Equal(len(edits), 3)
+	is.Equal(edits[0].Start, len("#!/usr/bin/env node\n"))
+	is.Equal(edits[1].Replacement, "__cjs_require__")
+	is.Equal(source[edits[1].Start:edits[1].End], "__require")
+	is.Equal(source[edits[2].Start:edits[2].End], "require2")
+
+	// Applying the edits reproduces the rewritten code
+	var sb strings.Builder
+	pos := 0
+	for _, edit := range edits {
+		sb.WriteString(source[pos:edit.Start])
+		sb.WriteString(edit.Replacement)
+		pos = edit.End
+	}
+	sb.WriteString(source[pos:])
+	expect, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	is.Equal(sb.String(), expect)
+
+	edits, err = cjs.RewriteRequiresEdits("test.js", "/node_modules/", `var a = require("./a");`)
+	is.NoErr(err)
+	is.Equal(len(edits), 0)
+}
+
+func TestEscapedRequirePath(t *testing.T) {
+	is := is.New(t)
+	source := `
+		var a = __require("/node_modules/react");
+		var b = __require('/node_modules/react\x2Ddom');
+		var c = __require(/node_modules/);
+	`
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+		var b = __cjs_require__('/node_modules/react\x2Ddom');
+		var c = __require(/node_modules/);
+	`)
+	// The prefix itself may be escaped
+	actual, err = cjs.RewriteRequires("test.js", "/node_modules/", `var a = __require("\u002Fnode_modules\u002Fa");`)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_a__ from "/node_modules/a"
+		const __cjs_imports__ = {
+			"/node_modules/a": __cjs_import_a__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("\u002Fnode_modules\u002Fa");
+	`)
+}
+
+func TestAnnotateReplacements(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.AnnotateReplacements = true
+	opts.AllowExtraArgs = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `var a = __require("/node_modules/react");
+var b = (0, require2)( "/node_modules/react" /* dom */ );
+var c = __webpack_require__("/node_modules/react", options);
+`, opts)
+	is.NoErr(err)
+	is.True(strings.HasSuffix(actual, `var a = __cjs_require__("/node_modules/react") /* was __require */;
+var b = (0, __cjs_require__)( "/node_modules/react" /* dom */ ) /* was require2 */;
+var c = __cjs_require__ /* was __webpack_require__ */("/node_modules/react", options);
+`))
+}
+
+func TestConcatenatedRequire(t *testing.T) {
+	is := is.New(t)
+	source := `
+		var a = __require("/node_modules/" + "react");
+		var b = __require("/node_modules/" + 'react' + "-dom");
+		var c = __require("/node_modules/" + name);
+	`
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/" + "react");
+		var b = __cjs_require__("/node_modules/" + 'react' + "-dom");
+		var c = __require("/node_modules/" + name);
+	`)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.StripQuery = true
+	opts.NormalizeSeparators = true
+	actual, err = cjs.RewriteRequiresWith("test.js", `var a = __require("\\node_modules\\" + "react");`, opts)
+	is.NoErr(err)
+	is.True(strings.HasSuffix(actual, `var a = __cjs_require__("/node_modules/react");`))
+	// The prefix can be split across the concatenation
+	actual, err = cjs.RewriteRequires("test.js", "/node_modules/", `var a = __require("/node_" + "modules/react");`)
+	is.NoErr(err)
+	is.True(strings.HasSuffix(actual, `var a = __cjs_require__("/node_" + "modules/react");`))
+}
+
+func TestInline(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.Inline = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `"use strict";
+var React = __require("/node_modules/react");
+var ReactDOM = __require( "/node_modules/react-dom" );
+var again = __require("/node_modules/react").Children;
+`, opts)
+	is.NoErr(err)
+	is.Equal(actual, `"use strict";
+import __cjs_import_react__ from "/node_modules/react"
+import __cjs_import_react_dom__ from "/node_modules/react-dom"
+var React = __cjs_import_react__;
+var ReactDOM = __cjs_import_react_dom__;
+var again = __cjs_import_react__.Children;
+`)
+
+	// Fall back to the helper when a call can't be inlined
+	actual, err = cjs.RewriteRequiresWith("test.js", `var a = __require("/node_modules/react");
+var b = (0, __require)("/node_modules/react-dom");
+`, opts)
+	is.NoErr(err)
+	is.True(strings.Contains(actual, "function __cjs_require__(path)"))
+	is.True(strings.HasSuffix(actual, `var a = __cjs_require__("/node_modules/react");
+var b = (0, __cjs_require__)("/node_modules/react-dom");
+`))
+}
+
+func TestOnMissing(t *testing.T) {
+	is := is.New(t)
+	source := `var a = __require("/node_modules/react");`
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	actual, err := cjs.RewriteRequiresWith("test.js", source, opts)
+	is.NoErr(err)
+	is.True(strings.Contains(actual, `
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+`))
+	opts.OnMissing = cjs.ReturnUndefined
+	actual, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				return undefined
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+	`)
+}
+
+func TestStripPrefixInImport(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules")
+	opts.StripPrefixInImport = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = __require("/node_modules/react");
+		var client = __require('/node_modules/react-dom/client');
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "react"
+		import __cjs_import_client__ from "react-dom/client"
+		const __cjs_imports__ = {
+			"react": __cjs_import_react__,
+			"react-dom/client": __cjs_import_client__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("react");
+		var client = __cjs_require__("react-dom/client");
+	`)
+}
+
+func TestCanonicalizePaths(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.CanonicalizePaths = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var a = __require("/node_modules/react");
+		var b = __require("/node_modules/react/");
+		var c = __require("/node_modules/react/index.js");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_index_js__ from "/node_modules/react/index.js"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react/index.js": __cjs_import_index_js__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+		var b = __cjs_require__("/node_modules/react");
+		var c = __cjs_require__("/node_modules/react/index.js");
+	`)
+	opts.CanonicalizeIndex = true
+	actual, err = cjs.RewriteRequiresWith("test.js", `
+		var a = __require("/node_modules/react/");
+		var c = __require("/node_modules/react/index.js");
+		var d = __require("/node_modules/react/index");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var a = __cjs_require__("/node_modules/react");
+		var c = __cjs_require__("/node_modules/react");
+		var d = __cjs_require__("/node_modules/react");
+	`)
+}
+
+func TestInteropDefault(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.InteropDefault = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `var React = __require("/node_modules/react");`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__.default ?? __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/node_modules/react");
+	`)
+	opts.Inline = true
+	actual, err = cjs.RewriteRequiresWith("test.js", `var Children = __require("/node_modules/react").Children;`, opts)
+	is.NoErr(err)
+	is.Equal(actual, `import __cjs_import_react__ from "/node_modules/react"
+var Children = (__cjs_import_react__.default ?? __cjs_import_react__).Children;`)
+}
+
+func TestRemapPrefix(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.RemapPrefix = map[string]string{
+		"/node_modules/":        "/cdn/",
+		"/node_modules/@scope/": "/cdn/scoped/",
+	}
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = __require("/node_modules/react");
+		var pkg = __require("/node_modules/@scope/pkg");
+		var local = __require("./local");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/cdn/react"
+		import __cjs_import_pkg__ from "/cdn/scoped/pkg"
+		const __cjs_imports__ = {
+			"/cdn/react": __cjs_import_react__,
+			"/cdn/scoped/pkg": __cjs_import_pkg__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/cdn/react");
+		var pkg = __cjs_require__("/cdn/scoped/pkg");
+		var local = __require("./local");
+	`)
+}
+
+func TestRequireKeepShebang(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.KeepShebang = true
+	actual, err := cjs.RewriteRequiresWith("test.js", "#!/usr/bin/env node\nvar React = __require(\"/node_modules/react\");", opts)
+	is.NoErr(err)
+	is.True(strings.HasPrefix(actual, "#!/usr/bin/env node\nimport __cjs_import_react__ from \"/node_modules/react\"\n"))
+	_, err = cjs.RewriteRequiresWith("test.js", "\n#!/usr/bin/env node\nvar React = __require(\"/node_modules/react\");", opts)
+	var perr *cjs.ParseError
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Line, 2)
+}
+
+func TestMemberRequire(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.RewriteRequiresResult("test.js", `
+		var x = __runtime.require("/node_modules/x");
+		var y = (0, __runtime.modules.require)("/node_modules/y");
+	`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.RequireFuncs, []string{"__runtime.modules.require", "__runtime.require"})
+	requiresEqual(t, result.Code, `
+		import __cjs_import_x__ from "/node_modules/x"
+		import __cjs_import_y__ from "/node_modules/y"
+		const __cjs_imports__ = {
+			"/node_modules/x": __cjs_import_x__,
+			"/node_modules/y": __cjs_import_y__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var x = __cjs_require__("/node_modules/x");
+		var y = (0, __cjs_require__)("/node_modules/y");
+	`)
+}
+
+func TestListRequires(t *testing.T) {
+	is := is.New(t)
+	paths, err := cjs.ListRequires("test.js", "/node_modules/", `
+		var b = __require("/node_modules/b");
+		var a = require("/node_modules/a");
+		var again = __require("/node_modules/b");
+		var local = require("./local");
+	`)
+	is.NoErr(err)
+	is.Equal(paths, []string{"/node_modules/b", "/node_modules/a"})
+	paths, err = cjs.ListRequires("test.js", "/node_modules/", `var local = require("./local");`)
+	is.NoErr(err)
+	is.Equal(paths, []string{})
+}
+
+func TestExclude(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.Exclude = []string{"/node_modules/fsevents"}
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = __require("/node_modules/react");
+		var fsevents = __require("/node_modules/fsevents");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/node_modules/react");
+		var fsevents = __require("/node_modules/fsevents");
+	`)
+}
+
+func TestCommaDeclarators(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.NormalizeSeparators = true
+	result, err := cjs.RewriteRequiresResult("test.js", `var a=__require("/node_modules/a"),b=__r("\\node_modules\\b"),c=__require("/node_modules/a")(__r("/node_modules/c"));`, opts)
+	is.NoErr(err)
+	is.True(strings.HasSuffix(result.Code, "}\n"+`var a=__cjs_require__("/node_modules/a"),b=__cjs_require__("/node_modules/b"),c=__cjs_require__("/node_modules/a")(__cjs_require__("/node_modules/c"));`))
+	// The edits don't overlap
+	for i := 1; i < len(result.Edits); i++ {
+		is.True(result.Edits[i-1].End <= result.Edits[i].Start)
+	}
+}
+
+func TestWrapModule(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.WrapModule = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `"use strict";
+var React = __require("/node_modules/react");
+module.exports = React.createElement;
+`, opts)
+	is.NoErr(err)
+	is.Equal(actual, `"use strict";
+import __cjs_import_react__ from "/node_modules/react"
+const __cjs_imports__ = {
+	"/node_modules/react": __cjs_import_react__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+let module = { exports: {} };
+let exports = module.exports;
+var React = __cjs_require__("/node_modules/react");
+module.exports = React.createElement;
+export default module.exports;
+`)
+	// Modules without requires are wrapped too
+	actual, err = cjs.RewriteRequiresWith("test.js", `exports.a = 1;`, opts)
+	is.NoErr(err)
+	is.Equal(actual, "let module = { exports: {} };\nlet exports = module.exports;\nexports.a = 1;\nexport default module.exports;\n")
+	// The CommonJS locals can be reassigned
+	actual, err = cjs.RewriteRequiresWith("test.js", "exports = module.exports = createApplication;\nexports.version = 1;\n", opts)
+	is.NoErr(err)
+	is.Equal(actual, "let module = { exports: {} };\nlet exports = module.exports;\nexports = module.exports = createApplication;\nexports.version = 1;\nexport default module.exports;\n")
+}
+
+func TestRequiresInLiterals(t *testing.T) {
+	is := is.New(t)
+	result, err := cjs.RewriteRequiresResult("test.js", `var plugins = [__require("/node_modules/a"),__require("/node_modules/b")];
+var map = {a:__require("/node_modules/a"),"b":__require( "/node_modules/b" ),...__require("/node_modules/c")};
+`, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.Paths, []string{"/node_modules/a", "/node_modules/b", "/node_modules/c"})
+	is.True(strings.HasSuffix(result.Code, `}
+var plugins = [__cjs_require__("/node_modules/a"),__cjs_require__("/node_modules/b")];
+var map = {a:__cjs_require__("/node_modules/a"),"b":__cjs_require__( "/node_modules/b" ),...__cjs_require__("/node_modules/c")};
+`))
+}
+
+func TestGroupImports(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.SortImports = true
+	opts.GroupImports = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var jsx = __require("/node_modules/react/jsx-runtime");
+		var parser = __require("/node_modules/@babel/parser");
+		var ReactDOM = __require("/node_modules/react-dom");
+		var React = __require("/node_modules/react");
+		var core = __require("/node_modules/@babel/core");
+	`, opts)
+	is.NoErr(err)
+	is.True(strings.HasPrefix(actual, `import __cjs_import_core__ from "/node_modules/@babel/core"
+import __cjs_import_parser__ from "/node_modules/@babel/parser"
+
+import __cjs_import_react__ from "/node_modules/react"
+import __cjs_import_jsx_runtime__ from "/node_modules/react/jsx-runtime"
+
+import __cjs_import_react_dom__ from "/node_modules/react-dom"
+const __cjs_imports__ = {
+	"/node_modules/@babel/core": __cjs_import_core__,
+	"/node_modules/@babel/parser": __cjs_import_parser__,
+	"/node_modules/react": __cjs_import_react__,
+	"/node_modules/react/jsx-runtime": __cjs_import_jsx_runtime__,
+	"/node_modules/react-dom": __cjs_import_react_dom__,
+}
+`))
+}
+
+func TestRewriteJSOptions(t *testing.T) {
+	is := is.New(t)
+	code := "#!/usr/bin/env node\nvar React = __require(\"/node_modules/react\");"
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.KeepShebang = true
+	_, err := cjs.RewriteRequiresWith("test.js", code, opts)
+	is.NoErr(err)
+	// Inline scripts don't allow a hashbang
+	opts.JSOptions = js.Options{Inline: true}
+	_, err = cjs.RewriteRequiresWith("test.js", code, opts)
+	is.True(err != nil)
+}
+
+func TestRequireStatic(t *testing.T) {
+	is := is.New(t)
+	source := `
+		var React = __require("/node_modules/react");
+		var plugin = __require("/node_modules/" + name);
+		var other = require(variable);
+		var unrelated = String(variable);
+	`
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	actual, err := cjs.RewriteRequiresWith("test.js", source, opts)
+	is.NoErr(err)
+	is.True(strings.Contains(actual, `require(variable)`))
+	opts.RequireStatic = true
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.True(err != nil)
+	is.Equal(err.Error(), fmt.Sprintf(`cjs: test.js has requires that can't be imported statically: __require("/node_modules/" + name) at offset %d, require(variable) at offset %d`,
+		strings.Index(source, `__require("/node_modules/" +`), strings.Index(source, `require(variable)`)))
+	// Calls sharing a name are told apart, even around strings, comments and wrappers
+	source = "#!/usr/bin/env node\n" + `require(a); require("./b"); // require(c)
+var s = "require(d)", r = /require(e)/; (0, require)(f); function g() { require(h) }`
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.Equal(err.Error(), fmt.Sprintf(`cjs: test.js has requires that can't be imported statically: require(a) at offset %d, (0,require)(f) at offset %d, require(h) at offset %d`,
+		strings.Index(source, "require(a)"), strings.Index(source, "require)(f)"), strings.Index(source, "require(h)")))
+	// Object methods and constructors named require aren't calls to it
+	source = `var a = { require(y) { return 1 } };
+var b = require(z);`
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.Equal(err.Error(), "cjs: test.js has requires that can't be imported statically: require(z) at offset 45")
+	source = `var a = new require(y);
+var b = require(z);`
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.Equal(err.Error(), "cjs: test.js has requires that can't be imported statically: require(z) at offset 32")
+	source = `var x; var a = require?.(x);`
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.Equal(err.Error(), "cjs: test.js has requires that can't be imported statically: require?.(x) at offset 15")
+	// Identical calls in the same scope can't be told apart
+	source = `var x; require(x); require(x);`
+	_, err = cjs.RewriteRequiresWith("test.js", source, opts)
+	is.Equal(err.Error(), "cjs: test.js has requires that can't be imported statically: require(x), require(x)")
+}
+
+func TestDestructuredDefaultRequire(t *testing.T) {
+	is := is.New(t)
+	source := `const { default: X, other } = __require("/node_modules/react");
+const { "a-b": ab, c: d } = __require("/node_modules/dom");
+let { mutable } = __require("/node_modules/let");
+const { withDefault = 1 } = __require("/node_modules/defaults");
+function f() { const { inner } = __require("/node_modules/inner"); }
+`
+	actual, err := cjs.RewriteRequires("test.js", "/node_modules/", source)
+	is.NoErr(err)
+	is.True(strings.Contains(actual, `const { default: X, other } = __cjs_require__("/node_modules/react");`))
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.PreferNamedImports = true
+	result, err := cjs.RewriteRequiresResult("test.js", source, opts)
+	is.NoErr(err)
+	is.Equal(result.Code, `import __cjs_import_let__ from "/node_modules/let"
+import __cjs_import_defaults__ from "/node_modules/defaults"
+import __cjs_import_inner__ from "/node_modules/inner"
+const __cjs_imports__ = {
+	"/node_modules/let": __cjs_import_let__,
+	"/node_modules/defaults": __cjs_import_defaults__,
+	"/node_modules/inner": __cjs_import_inner__,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+import X, { other } from "/node_modules/react";
+import { "a-b" as ab, c as d } from "/node_modules/dom";
+let { mutable } = __cjs_require__("/node_modules/let");
+const { withDefault = 1 } = __cjs_require__("/node_modules/defaults");
+function f() { const { inner } = __cjs_require__("/node_modules/inner"); }
+`)
+	is.Equal(result.Paths, []string{"/node_modules/react", "/node_modules/dom", "/node_modules/let", "/node_modules/defaults", "/node_modules/inner"})
+	// Named imports alone don't need the require infrastructure
+	actual, err = cjs.RewriteRequiresWith("test.js", `"use strict";
+const { default: React, useState } = __require("/node_modules/react")
+`, opts)
+	is.NoErr(err)
+	is.Equal(actual, `"use strict";
+import React, { useState } from "/node_modules/react"
+`)
+}
+
+func TestRewriteResolve(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.Resolve = func(rawPath string) (string, bool) {
+		if rawPath == "./react" {
+			return "/node_modules/react", true
+		}
+		return "", false
+	}
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = require("./react");
+		var again = __require("/node_modules/react");
+		var local = require("./local");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		const __cjs_imports__ = {
+			"/node_modules/react": __cjs_import_react__,
+		}
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/node_modules/react");
+		var again = __cjs_require__("/node_modules/react");
+		var local = require("./local");
+	`)
+}
+
+func TestTryRequire(t *testing.T) {
+	is := is.New(t)
+	source := `var react = __require("/node_modules/react");
+var opt;
+try { opt = __require("/node_modules/opt") } catch {}
+try {} catch (err) { __require("/node_modules/fallback") }
+`
+	result, err := cjs.RewriteRequiresResult("test.js", source, cjs.DefaultRewriteOptions("/node_modules/"))
+	is.NoErr(err)
+	is.Equal(result.Diagnostics, []cjs.Diagnostic{
+		{
+			Offset:  strings.Index(source, `"/node_modules/opt"`),
+			Message: `"/node_modules/opt" is required inside a try block, so hoisting it to an import throws at import time when it's missing`,
+		},
+	})
+	is.Equal(result.Paths, []string{"/node_modules/react", "/node_modules/opt", "/node_modules/fallback"})
+	// Leave the optional dependency as a runtime require
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.KeepTryRequires = true
+	result, err = cjs.RewriteRequiresResult("test.js", source, opts)
+	is.NoErr(err)
+	is.Equal(len(result.Diagnostics), 0)
+	is.Equal(result.Paths, []string{"/node_modules/react", "/node_modules/fallback"})
+	is.True(strings.Contains(result.Code, `try { opt = __require("/node_modules/opt") } catch {}`))
+	is.True(strings.Contains(result.Code, `__cjs_require__("/node_modules/fallback")`))
+}
+
+func TestFreezeImports(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.FreezeImports = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `
+		var React = __require("/node_modules/react");
+		var ReactDOM = __require("/node_modules/react-dom");
+	`, opts)
+	is.NoErr(err)
+	requiresEqual(t, actual, `
+		import __cjs_import_react__ from "/node_modules/react"
+		import __cjs_import_react_dom__ from "/node_modules/react-dom"
+		const __cjs_imports__ = Object.freeze({
+			"/node_modules/react": __cjs_import_react__,
+			"/node_modules/react-dom": __cjs_import_react_dom__,
+		})
+		function __cjs_require__(path) {
+			const req = __cjs_imports__[path]
+			if (!req) {
+				throw new Error("Module not found: " + path)
+			}
+			return req
+		}
+		var React = __cjs_require__("/node_modules/react");
+		var ReactDOM = __cjs_require__("/node_modules/react-dom");
+	`)
+}
+
+func TestRewriteQuotesPathsForJavaScript(t *testing.T) {
+	is := is.New(t)
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.CanonicalizePaths = true
+	actual, err := cjs.RewriteRequiresWith("test.js", `var a = __require("/node_modules/a\x07\u{E0001}/");`, opts)
+	is.NoErr(err)
+	// Go escapes like \a and \U000E0001 aren't JavaScript
+	is.Equal(actual, `import __cjs_import_a____ from "/node_modules/a\x07\uDB40\uDC01"
+const __cjs_imports__ = {
+	"/node_modules/a\x07\uDB40\uDC01": __cjs_import_a____,
+}
+function __cjs_require__(path) {
+	const req = __cjs_imports__[path]
+	if (!req) {
+		throw new Error("Module not found: " + path)
+	}
+	return req
+}
+var a = __cjs_require__("/node_modules/a\x07\uDB40\uDC01");`)
+}
@@ -64,6 +64,7 @@ func TestData(t *testing.T) {
 		expectPath = filepath.Join("testdata", replaceExt(de.Name(), ".mjs"))
 		actualRewrite, err := cjs.RewriteRequires(inputPath, "/node_modules/", string(inputBytes))
 		is.NoErr(err)
+		is.NoErr(cjs.VerifyRewrite(string(inputBytes), actualRewrite))
 
 		if *update {
 			err = os.WriteFile(expectPath, []byte(actualRewrite), 0644)
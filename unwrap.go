@@ -0,0 +1,55 @@
+package cjs
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// infrastructurePattern matches the imports, __cjs_imports__ and
+// __cjs_require__ that RewriteRequires injects
+var infrastructurePattern = regexp.MustCompile(`(?s)(?:import __cjs_import_\w+__ from "(?:[^"\\\n]|\\.)*"\n\n?)*const __cjs_imports__ = (?:Object\.freeze\()?\{\n.*?\n\}\)?\nfunction __cjs_require__\(path\) \{\n.*?\n\treturn req\n\}\n`)
+
+// UnwrapRequires reverses RewriteRequires by removing the injected imports
+// and helper, and turning __cjs_require__("/path") calls back into
+// require("/path"). Inlined imports can't be reversed.
+func UnwrapRequires(rewritten string) (string, error) {
+	loc := infrastructurePattern.FindStringIndex(rewritten)
+	if loc == nil {
+		return "", errors.New("cjs: unable to find the __cjs_require__ infrastructure")
+	}
+	shebang, code := extractShebang(rewritten[:loc[0]] + rewritten[loc[1]:])
+
+	// Rename the helper where it's used as an identifier, skipping strings,
+	// comments and regular expressions
+	var sb strings.Builder
+	sb.WriteString(shebang)
+	lexer := js.NewLexer(parse.NewInputString(code))
+	prev := js.ErrorToken
+	for {
+		tt, data := lexer.Next()
+		switch tt {
+		case js.ErrorToken:
+			if err := lexer.Err(); err != io.EOF {
+				return "", err
+			}
+			return sb.String(), nil
+		case js.DivToken, js.DivEqToken:
+			if !endsExpression(prev) {
+				tt, data = lexer.RegExp()
+			}
+		case js.IdentifierToken:
+			if string(data) == "__cjs_require__" {
+				data = []byte("require")
+			}
+		}
+		sb.Write(data)
+		if tt != js.WhitespaceToken && tt != js.LineTerminatorToken && tt != js.CommentToken && tt != js.CommentLineTerminatorToken {
+			prev = tt
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package cjs_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestUnwrapRequires(t *testing.T) {
+	is := is.New(t)
+	original := `#!/usr/bin/env node
+"use strict";
+var React = require("/node_modules/react");
+var ReactDOM = require("/node_modules/react-dom"), again = require("/node_modules/react");
+var name = "__cjs_require__", re = /__cjs_require__/g;
+`
+	rewritten, err := cjs.RewriteRequires("test.js", "/node_modules/", original)
+	is.NoErr(err)
+	unwrapped, err := cjs.UnwrapRequires(rewritten)
+	is.NoErr(err)
+	is.Equal(unwrapped, original)
+	// Running the transform again gives the same result
+	again, err := cjs.RewriteRequires("test.js", "/node_modules/", unwrapped)
+	is.NoErr(err)
+	is.Equal(again, rewritten)
+	// Frozen imports unwrap the same way
+	opts := cjs.RewriteOptions{Prefix: "/node_modules/", FreezeImports: true}
+	rewritten, err = cjs.RewriteRequiresWith("test.js", original, opts)
+	is.NoErr(err)
+	unwrapped, err = cjs.UnwrapRequires(rewritten)
+	is.NoErr(err)
+	is.Equal(unwrapped, original)
+
+	_, err = cjs.UnwrapRequires(original)
+	is.Equal(err.Error(), "cjs: unable to find the __cjs_require__ infrastructure")
+}
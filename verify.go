@@ -0,0 +1,212 @@
+package cjs
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// VerifyRewrite checks that rewritten, the output of RewriteRequires for
+// original, only differs from original by the injected imports and require
+// infrastructure and the renamed require calls, whose paths may only differ
+// by separators, trailing slashes and index files. Any other difference in
+// the syntax tree is returned as an error.
+func VerifyRewrite(original, rewritten string) error {
+	originalAST, err := parseWithoutShebang(original)
+	if err != nil {
+		return fmt.Errorf("cjs: unable to parse the original code: %w", err)
+	}
+	rewrittenAST, err := parseWithoutShebang(rewritten)
+	if err != nil {
+		return fmt.Errorf("cjs: unable to parse the rewritten code: %w", err)
+	}
+
+	// Remove the injected infrastructure
+	var stmts []js.IStmt
+	for _, stmt := range rewrittenAST.BlockStmt.List {
+		if !isInfrastructure(stmt) {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	if len(stmts) != len(originalAST.BlockStmt.List) {
+		return fmt.Errorf("cjs: rewritten code has %d statements, but the original has %d", len(stmts), len(originalAST.BlockStmt.List))
+	}
+	for i, stmt := range stmts {
+		if !equalNodes(reflect.ValueOf(originalAST.BlockStmt.List[i]), reflect.ValueOf(stmt)) {
+			return fmt.Errorf("cjs: rewritten statement %d differs from the original: %s", i+1, jsString(stmt))
+		}
+	}
+	return nil
+}
+
+func parseWithoutShebang(code string) (*js.AST, error) {
+	_, code = extractShebang(code)
+	return js.Parse(parse.NewInputString(code), js.Options{})
+}
+
+// isInfrastructure reports whether the statement was injected by
+// RewriteRequires
+func isInfrastructure(stmt js.IStmt) bool {
+	switch stmt := stmt.(type) {
+	case *js.ImportStmt:
+		return strings.HasPrefix(string(stmt.Default), "__cjs_import_")
+	case *js.VarDecl:
+		if len(stmt.List) != 1 {
+			return false
+		}
+		ident, ok := stmt.List[0].Binding.(*js.Var)
+		return ok && string(ident.Data) == "__cjs_imports__"
+	case *js.FuncDecl:
+		return stmt.Name != nil && string(stmt.Name.Data) == "__cjs_require__"
+	}
+	return false
+}
+
+var (
+	varType      = reflect.TypeOf(&js.Var{})
+	callExprType = reflect.TypeOf(&js.CallExpr{})
+	scopeType    = reflect.TypeOf(js.Scope{})
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// equalNodes compares the original node with the rewritten node, allowing
+// require calls with a constant path to be renamed to __cjs_require__
+func equalNodes(original, rewritten reflect.Value) bool {
+	if original.Kind() != rewritten.Kind() {
+		return false
+	}
+	switch original.Kind() {
+	case reflect.Interface:
+		if original.IsNil() || rewritten.IsNil() {
+			return original.IsNil() == rewritten.IsNil()
+		}
+		return equalNodes(original.Elem(), rewritten.Elem())
+	case reflect.Pointer:
+		if original.IsNil() || rewritten.IsNil() {
+			return original.IsNil() == rewritten.IsNil()
+		} else if original.Type() != rewritten.Type() {
+			return false
+		}
+		switch original.Type() {
+		case varType:
+			// Variables are shared between uses, so only compare the names
+			return bytes.Equal(original.Interface().(*js.Var).Name(), rewritten.Interface().(*js.Var).Name())
+		case callExprType:
+			return equalCalls(original.Interface().(*js.CallExpr), rewritten.Interface().(*js.CallExpr))
+		}
+		return equalNodes(original.Elem(), rewritten.Elem())
+	case reflect.Struct:
+		if original.Type() != rewritten.Type() {
+			return false
+		} else if original.Type() == scopeType {
+			return true // Scopes differ by the renamed variables
+		}
+		for i := 0; i < original.NumField(); i++ {
+			if !equalNodes(original.Field(i), rewritten.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if original.Type() == bytesType {
+			return bytes.Equal(original.Bytes(), rewritten.Bytes())
+		} else if original.Len() != rewritten.Len() {
+			return false
+		}
+		for i := 0; i < original.Len(); i++ {
+			if !equalNodes(original.Index(i), rewritten.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return original.Bool() == rewritten.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return original.Int() == rewritten.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return original.Uint() == rewritten.Uint()
+	case reflect.String:
+		return original.String() == rewritten.String()
+	}
+	return false
+}
+
+// verifyPaths normalizes require paths the way RewriteRequires may have
+var verifyPaths = RewriteOptions{
+	NormalizeSeparators: true,
+	CanonicalizePaths:   true,
+	CanonicalizeIndex:   true,
+}
+
+// equalCalls compares calls, allowing a require call with a constant path to
+// become a __cjs_require__ call of the same normalized path
+func equalCalls(original, rewritten *js.CallExpr) bool {
+	if len(original.Args.List) != len(rewritten.Args.List) || original.Optional != rewritten.Optional {
+		return false
+	}
+	start := 0
+	if isRequireCall(rewritten) {
+		if len(original.Args.List) == 0 || !equalRequireCallee(original.X, rewritten.X) {
+			return false
+		}
+		originalPath, _, _, ok1 := constantString(unwrapGroup(original.Args.List[0].Value))
+		rewrittenPath, _, _, ok2 := constantString(unwrapGroup(rewritten.Args.List[0].Value))
+		if !ok1 || !ok2 || verifyPaths.requireKey(originalPath) != verifyPaths.requireKey(rewrittenPath) {
+			return false
+		}
+		start = 1
+	} else if !equalNodes(reflect.ValueOf(original.X), reflect.ValueOf(rewritten.X)) {
+		return false
+	}
+	for i := start; i < len(original.Args.List); i++ {
+		if !equalNodes(reflect.ValueOf(original.Args.List[i]), reflect.ValueOf(rewritten.Args.List[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalRequireCallee reports whether the rewritten callee is the original
+// require function renamed to __cjs_require__, keeping wrappers like
+// (0, __require)
+func equalRequireCallee(original, rewritten js.IExpr) bool {
+	switch rewritten := rewritten.(type) {
+	case *js.Var:
+		switch original.(type) {
+		case *js.Var, *js.DotExpr:
+			return string(rewritten.Data) == "__cjs_require__"
+		}
+	case *js.GroupExpr:
+		if original, ok := original.(*js.GroupExpr); ok {
+			return equalRequireCallee(original.X, rewritten.X)
+		}
+	case *js.CommaExpr:
+		original, ok := original.(*js.CommaExpr)
+		if !ok || len(original.List) != len(rewritten.List) || len(original.List) == 0 {
+			return false
+		}
+		last := len(original.List) - 1
+		for i := 0; i < last; i++ {
+			if !equalNodes(reflect.ValueOf(original.List[i]), reflect.ValueOf(rewritten.List[i])) {
+				return false
+			}
+		}
+		return equalRequireCallee(original.List[last], rewritten.List[last])
+	}
+	return false
+}
+
+// isRequireCall reports whether the call is to __cjs_require__, possibly
+// wrapped like (0, __cjs_require__)
+func isRequireCall(call *js.CallExpr) bool {
+	callee := unwrapGroup(call.X)
+	if comma, ok := callee.(*js.CommaExpr); ok && len(comma.List) > 0 {
+		callee = comma.List[len(comma.List)-1]
+	}
+	return isIdentNamed(callee, "__cjs_require__")
+}
@@ -0,0 +1,46 @@
+package cjs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/cjs"
+)
+
+func TestVerifyRewrite(t *testing.T) {
+	is := is.New(t)
+	original := `#!/usr/bin/env node
+"use strict";
+var React = __require("/node_modules/react");
+var ReactDOM = (0, require2)("/node_modules/react-dom");
+var local = require("./local");
+console.log(React, ReactDOM, local);
+`
+	opts := cjs.DefaultRewriteOptions("/node_modules/")
+	opts.NormalizeSeparators = true
+	rewritten, err := cjs.RewriteRequiresWith("test.js", original, opts)
+	is.NoErr(err)
+	is.NoErr(cjs.VerifyRewrite(original, rewritten))
+
+	// Changes outside of the requires are caught
+	err = cjs.VerifyRewrite(original, strings.Replace(rewritten, "console.log(React", "console.log(Vue", 1))
+	is.True(err != nil)
+	is.Equal(err.Error(), "cjs: rewritten statement 5 differs from the original: console.log(Vue, ReactDOM, local);")
+	err = cjs.VerifyRewrite(original, strings.Replace(rewritten, `require("./local")`, `require("./other")`, 1))
+	is.True(err != nil)
+	err = cjs.VerifyRewrite(original, strings.Replace(rewritten, "var local", "let local", 1))
+	is.True(err != nil)
+
+	// Only require calls can be renamed, and only to the same path
+	err = cjs.VerifyRewrite(original, strings.Replace(rewritten, `"/node_modules/react");`, `"/node_modules/vue");`, 1))
+	is.True(err != nil)
+	is.Equal(err.Error(), `cjs: rewritten statement 2 differs from the original: var React = __cjs_require__("/node_modules/vue")`)
+	err = cjs.VerifyRewrite("foo(1);\n", "__cjs_require__(1);\n")
+	is.True(err != nil)
+	err = cjs.VerifyRewrite("foo(\"/node_modules/react\");\nvar x = foo;\n", "__cjs_require__(\"/node_modules/react\");\nvar x = __cjs_require__;\n")
+	is.True(err != nil)
+	is.Equal(err.Error(), "cjs: rewritten statement 2 differs from the original: var x = __cjs_require__")
+	// Paths may be normalized
+	is.NoErr(cjs.VerifyRewrite(`var a = __require("\\node_modules\\a\\index.js");`, `var a = __cjs_require__("/node_modules/a");`))
+}